@@ -0,0 +1,135 @@
+package hub
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Djoulzy/Tools/clog"
+)
+
+const DefaultHistorySize = 100
+
+type historyEntry struct {
+	seq     uint64
+	content []byte
+}
+
+// history is a bounded ring buffer of the last frames sent for one key
+// (a topic, or the users broadcast).
+type history struct {
+	entries []historyEntry
+	start   int
+	count   int
+}
+
+func newHistory(size int) *history {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	return &history{entries: make([]historyEntry, size)}
+}
+
+func (r *history) push(entry historyEntry) {
+	size := len(r.entries)
+	if r.count < size {
+		r.entries[(r.start+r.count)%size] = entry
+		r.count++
+	} else {
+		r.entries[r.start] = entry
+		r.start = (r.start + 1) % size
+	}
+}
+
+// since returns the kept entries with a sequence number greater than seq, oldest first.
+func (r *history) since(seq uint64) []historyEntry {
+	var list []historyEntry
+	for i := 0; i < r.count; i++ {
+		entry := r.entries[(r.start+i)%len(r.entries)]
+		if entry.seq > seq {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// nextSeq returns a new sequence number. Sequence numbers are local to this hub.
+func (h *Hub) nextSeq() uint64 {
+	h.seq++
+	return h.seq
+}
+
+// keep stores a numbered frame in the history of key.
+func (h *Hub) keep(key string, seq uint64, content []byte) {
+	if h.histories[key] == nil {
+		h.histories[key] = newHistory(h.HistorySize)
+	}
+	h.histories[key].push(historyEntry{seq: seq, content: content})
+}
+
+// replay sends to a reconnecting client every kept frame it may have missed:
+// the users broadcasts and the messages of the topics it is subscribed to.
+// The replay ends with [RPLY]<seq>, seq being the current sequence number, or
+// the one of the last frame queued when the Send buffer of the client could
+// not hold them all: the client then asks again from there.
+// Replayed frames bypass the overflow policies, which would drop some of them.
+func (h *Hub) replay(req *ReplayRequest) {
+	if !h.isRegistered(req.Client) {
+		return
+	}
+
+	var list []historyEntry
+	broadcasts := TenantName(req.Client.App_id, "")
+	if req.Client.CType == ClientUser && h.histories[broadcasts] != nil {
+		list = append(list, h.histories[broadcasts].since(req.LastSeq)...)
+	}
+	for topic := range h.subscriptions[req.Client.ID] {
+		if h.histories[topic] != nil {
+			list = append(list, h.histories[topic].since(req.LastSeq)...)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].seq < list[j].seq })
+
+	// One slot is kept for [RPLY]. Other goroutines may write to the client
+	// meanwhile, so every send is non-blocking.
+	last := req.LastSeq
+	room := cap(req.Client.Send) - len(req.Client.Send) - 1
+	queued := 0
+	for _, entry := range list {
+		if queued >= room {
+			break
+		}
+		select {
+		case req.Client.Send <- entry.content:
+			last = entry.seq
+			queued++
+			atomic.AddInt64(&h.sent, 1)
+		default:
+			room = queued
+		}
+	}
+	if queued == len(list) {
+		last = h.seq
+	}
+
+	rply := []byte(fmt.Sprintf("[RPLY]%d", last))
+	select {
+	case req.Client.Send <- rply:
+		return
+	default:
+	}
+	// No room left: the oldest queued frame gives way to the answer, which
+	// the client can't do without. It is counted as dropped, and may be a
+	// replayed one, so the client is told to ask again from the start.
+	select {
+	case <-req.Client.Send:
+		h.shardOf(req.Client.Name).drop(req.Client)
+	default:
+	}
+	rply = []byte(fmt.Sprintf("[RPLY]%d", req.LastSeq))
+	select {
+	case req.Client.Send <- rply:
+	default:
+		clog.Warn("Hub", "replay", "Cannot answer the replay of %s", req.Client.Name)
+	}
+}
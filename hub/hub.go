@@ -3,6 +3,11 @@ package hub
 import (
 	"encoding/json"
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// "github.com/davecgh/go-spew/spew"
 	"github.com/Djoulzy/Tools/clog"
@@ -18,6 +23,9 @@ const (
 
 var CTYpeName = [4]string{"Incomming", "Users", "Servers", "Monitors"}
 
+// SupersededReason closes a user which logged in again, here or on a brother.
+const SupersededReason = "Superseded by a new login"
+
 // const (
 // 	ReadOnly  = 1
 // 	WriteOnly = 2
@@ -41,58 +49,134 @@ type Client struct {
 	App_id     string
 	Country    string
 	User_agent string
+	Framing    int       // Set at [HELO], see protocol.Framing*
+	Outbound   bool      // Mesh link dialed by this server
+	Reason     string    // Sent to the client when the hub closes its connection
+	Since      time.Time // Set by the hub at registration
+
+	drops      int64
+	overflowed int32
+	closed     int32 // Set once unregistered, its channels are closed
 }
 
 type Message struct {
 	UserType int
 	Dest     *Client
+	AppID    string
+	Topic    string
 	Content  []byte
+	History  bool
 }
 
-type ConnModifier struct {
+type ReplayRequest struct {
 	Client  *Client
-	NewName string
-	NewType int
+	LastSeq uint64
+}
+
+// ClientsRequest asks the hub for the clients of a type, answered on Reply.
+type ClientsRequest struct {
+	CType int
+	Reply chan []*Client
+}
+
+type Subscription struct {
+	Client *Client
+	Topic  string
+}
+
+type ConnModifier struct {
+	Client   *Client
+	NewName  string
+	NewType  int
+	NewAppID string
+	NewAddr  string // Addr is kept when empty
+
+	done chan bool
 }
 
 type Hub struct {
-	// Registered clients.
-	Incomming map[string]*Client
-	Users     map[string]*Client
-	Servers   map[string]*Client
-	Monitors  map[string]*Client
+	// Registered clients, hashed by name.
+	shards []*shard
+	sent   int64
+
+	// Topics subscribers and subscriptions of each client, both indexed by client ID
+	// so that they survive a Newrole.
+	Topics        map[string](map[string]*Client)
+	subscriptions map[string](map[string]bool)
+	topicsMutex   sync.RWMutex
+
+	// Last frames sent to users, indexed by TenantName(app_id, topic), with an
+	// empty topic for the broadcasts.
+	HistorySize int
+	histories   map[string]*history
+	seq         uint64
 
-	SentMessByTicks int
+	// Overflow policy of each client type, see Overflow*.
+	Overflow [4]int
 
-	FullUsersList [4](map[string]*Client)
+	// OnLeave, when set, is called in its own goroutine with each user
+	// leaving the hub.
+	OnLeave func(client *Client)
 
 	// Inbound messages from the clients.
 	Register   chan *Client
 	Unregister chan *Client
 	Broadcast  chan *Message
 	// Status     chan *Message
-	Unicast chan *Message
-	Action  chan *Message
-	Done    chan bool
+	Unicast     chan *Message
+	Action      chan *Message
+	Subscribe   chan *Subscription
+	Unsubscribe chan *Subscription
+	Publish     chan *Message
+	Replay      chan *ReplayRequest
+	List        chan *ClientsRequest
+	Done        chan bool
+
+	barrier  chan bool
+	newroles chan *ConnModifier
+	running  int32
+	stopped  chan bool
 }
 
+// NewHub returns a hub with one shard by CPU.
 func NewHub() *Hub {
+	return NewShardedHub(runtime.NumCPU())
+}
+
+// NewShardedHub returns a hub spreading its clients over n shards. Broadcasts
+// are delivered by all the shards at once.
+func NewShardedHub(n int) *Hub {
+	if n < 1 {
+		n = 1
+	}
 	hub := &Hub{
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
 
 		Broadcast: make(chan *Message),
 		// Status:    make(chan *Message),
-		Unicast: make(chan *Message),
-		Action:  make(chan *Message),
-		Done:    make(chan bool),
-
-		Users:     make(map[string]*Client),
-		Incomming: make(map[string]*Client),
-		Servers:   make(map[string]*Client),
-		Monitors:  make(map[string]*Client),
+		Unicast:     make(chan *Message),
+		Action:      make(chan *Message),
+		Subscribe:   make(chan *Subscription),
+		Unsubscribe: make(chan *Subscription),
+		Publish:     make(chan *Message),
+		Replay:      make(chan *ReplayRequest),
+		List:        make(chan *ClientsRequest),
+		Done:        make(chan bool),
+
+		barrier:  make(chan bool),
+		newroles: make(chan *ConnModifier),
+		stopped:  make(chan bool),
+
+		Topics:        make(map[string](map[string]*Client)),
+		subscriptions: make(map[string](map[string]bool)),
+
+		HistorySize: DefaultHistorySize,
+		histories:   make(map[string]*history),
+	}
+	for i := 0; i < n; i++ {
+		hub.shards = append(hub.shards, newShard())
 	}
-	hub.FullUsersList = [4](map[string]*Client){hub.Incomming, hub.Users, hub.Servers, hub.Monitors}
 	return hub
 }
 
@@ -105,92 +189,370 @@ func NewMessage(userType int, c *Client, content []byte) *Message {
 	return m
 }
 
+// NewHistoryMessage builds a broadcast to the users of app_id, kept in history and
+// sent as [BCST]<seq>|<content>.
+func NewHistoryMessage(app_id string, content []byte) *Message {
+	m := &Message{
+		UserType: ClientUser,
+		AppID:    app_id,
+		Content:  content,
+		History:  true,
+	}
+	return m
+}
+
+// NewTopicMessage builds a message for the subscribers of topic in app_id,
+// sent as [PUBL]<topic>|<seq>|<content>.
+func NewTopicMessage(app_id string, topic string, content []byte) *Message {
+	m := &Message{
+		UserType: Everybody,
+		AppID:    app_id,
+		Topic:    topic,
+		Content:  content,
+	}
+	return m
+}
+
+// TenantSeparator joins an App_id and a name in TenantName.
+const TenantSeparator = "/"
+
+// TenantName qualifies a user name or a topic with its App_id, so that two
+// applications can use the same names. Names of the empty App_id are unchanged.
+// Neither the App_id nor the name can contain TenantSeparator, see ValidName.
+func TenantName(app_id string, name string) string {
+	if app_id == "" {
+		return name
+	}
+	return app_id + TenantSeparator + name
+}
+
+// ValidName tells if an App_id, user name or topic given by a client can be
+// qualified by TenantName without being mistaken for the name of another
+// application, nor for the reserved BroadcastTopic.
+func ValidName(name string) bool {
+	return name != BroadcastTopic && !strings.Contains(name, TenantSeparator)
+}
+
+// SplitTenantName is the reverse of TenantName.
+func SplitTenantName(qualified string) (string, string) {
+	if i := strings.Index(qualified, TenantSeparator); i >= 0 {
+		return qualified[:i], qualified[i+1:]
+	}
+	return "", qualified
+}
+
+// TenantSize returns the number of users connected for app_id.
+func (h *Hub) TenantSize(app_id string) int {
+	size := 0
+	for _, s := range h.shards {
+		s.mu.RLock()
+		size += len(s.tenants[app_id])
+		s.mu.RUnlock()
+	}
+	return size
+}
+
+// Count returns the number of registered clients of type ctype.
+func (h *Hub) Count(ctype int) int {
+	count := 0
+	for _, s := range h.shards {
+		s.mu.RLock()
+		count += len(s.clients[ctype])
+		s.mu.RUnlock()
+	}
+	return count
+}
+
+// SentMessages returns the number of messages queued since the last ResetSentMessages.
+func (h *Hub) SentMessages() int {
+	sent := atomic.LoadInt64(&h.sent)
+	for _, s := range h.shards {
+		sent += atomic.LoadInt64(&s.sent)
+	}
+	return int(sent)
+}
+
+func (h *Hub) ResetSentMessages() {
+	atomic.StoreInt64(&h.sent, 0)
+	for _, s := range h.shards {
+		atomic.StoreInt64(&s.sent, 0)
+	}
+}
+
+// GetClientByName, UserExists and IsRegistered see the result of the
+// requests already sent to the hub channels.
 func (h *Hub) GetClientByName(name string, userType int) *Client {
-	return h.FullUsersList[userType][name]
+	h.sync()
+	return h.lookup(name, userType)
 }
 
 func (h *Hub) UserExists(name string, userType int) bool {
-	if h.FullUsersList[userType][name] != nil {
-		return true
-	} else {
-		return false
-	}
+	return h.GetClientByName(name, userType) != nil
 }
 
 func (h *Hub) IsRegistered(client *Client) bool {
-	if h.FullUsersList[client.CType][client.Name] != nil {
-		if h.FullUsersList[client.CType][client.Name].ID == client.ID {
-			return true
-		}
-	}
-	return false
+	h.sync()
+	return h.isRegistered(client)
 }
 
 func (h *Hub) register(client *Client) {
 	client.ID = fmt.Sprintf("%p", client)
+	s := h.shardOf(client.Name)
 
-	if h.UserExists(client.Name, client.CType) {
+	for {
+		if atomic.LoadInt32(&client.closed) == 1 {
+			clog.Warn("Hub", "Register", "Client %s is closed, not registering it", client.Name)
+			return
+		}
+		s.mu.Lock()
+		existing := s.clients[client.CType][client.Name]
+		if existing == nil {
+			client.Since = time.Now()
+			s.add(client)
+			s.mu.Unlock()
+			h.joined(client)
+			break
+		}
+		s.mu.Unlock()
 		clog.Warn("Hub", "Register", "Client %s already exists ... replacing", client.Name)
-		h.unregister(h.FullUsersList[client.CType][client.Name])
+		h.unregister(existing)
 	}
-
-	h.FullUsersList[client.CType][client.Name] = client
 	clog.Info("Hub", "Register", "Client %s registered [%s] as %s.", client.Name, client.ID, CTYpeName[client.CType])
 }
 
 func (h *Hub) unregister(client *Client) {
-	if h.IsRegistered(client) {
-		delete(h.FullUsersList[client.CType], client.Name)
+	s := h.shardOf(client.Name)
+	s.mu.Lock()
+	registered := s.clients[client.CType][client.Name]
+	if registered == nil || registered.ID != client.ID {
+		s.mu.Unlock()
+		return
+	}
+	s.remove(client)
+	s.mu.Unlock()
 
-		select {
-		case client.Quit <- true:
-		}
+	h.topicsMutex.RLock()
+	keys := make([]string, 0, len(h.subscriptions[client.ID]))
+	for key := range h.subscriptions[client.ID] {
+		keys = append(keys, key)
+	}
+	h.topicsMutex.RUnlock()
+	for _, key := range keys {
+		h.removeSubscription(client, key)
+	}
+	h.left(client)
 
-		close(client.Send)
-		close(client.Quit)
-
-		if client.CType == ClientServer {
-			data := struct {
-				SID  string
-				DOWN bool
-			}{
-				client.Name,
-				true,
-			}
-			json, _ := json.Marshal(data)
-			mess := NewMessage(ClientMonitor, nil, json)
-			clog.Trace("Hub", "Unregister", "Broadcasting close of server %s : %s", client.Name, json)
-			h.broadcast(mess)
+	// The writer of the client may be gone already (write error, dead
+	// peer): the hub must not wait for it.
+	select {
+	case client.Quit <- true:
+	default:
+	}
+
+	close(client.Send)
+	close(client.Quit)
+	atomic.StoreInt32(&client.closed, 1)
+
+	if client.CType == ClientServer {
+		data := struct {
+			SID  string
+			DOWN bool
+		}{
+			client.Name,
+			true,
 		}
-		clog.Info("Hub", "Unregister", "Client %s unregistered [%s] from %s.", client.Name, client.ID, CTYpeName[client.CType])
+		json, _ := json.Marshal(data)
+		mess := NewMessage(ClientMonitor, nil, json)
+		clog.Trace("Hub", "Unregister", "Broadcasting close of server %s : %s", client.Name, json)
+		h.broadcast(mess)
 	}
+	clog.Info("Hub", "Unregister", "Client %s unregistered [%s] from %s.", client.Name, client.ID, CTYpeName[client.CType])
 }
 
+// Newrole renames a registered client and changes its type, possibly moving
+// it to another shard. It returns once the hub goroutine has done it, as the
+// client already holding the new name is unregistered.
 func (h *Hub) Newrole(modif *ConnModifier) {
-	if h.UserExists(modif.NewName, modif.NewType) {
+	if atomic.LoadInt32(&h.running) == 0 {
+		h.newrole(modif)
+		return
+	}
+	modif.done = make(chan bool)
+	select {
+	case h.newroles <- modif:
+		<-modif.done
+	case <-h.stopped:
+	}
+}
+
+func (h *Hub) newrole(modif *ConnModifier) {
+	if modif.done != nil {
+		defer close(modif.done)
+	}
+	if existing := h.lookup(modif.NewName, modif.NewType); existing != nil && existing != modif.Client {
 		clog.Warn("Hub", "Newrole", "Client already exists ... Deleting")
-		h.unregister(h.GetClientByName(modif.NewName, modif.NewType))
+		existing.Reason = SupersededReason
+		h.unregister(existing)
+	}
+
+	from := h.shardOf(modif.Client.Name)
+	to := h.shardOf(modif.NewName)
+	from.mu.Lock()
+	if to != from {
+		to.mu.Lock()
+	}
+	moved := from.clients[modif.Client.CType][modif.Client.Name] == modif.Client
+	before := Client{Name: modif.Client.Name, CType: modif.Client.CType, App_id: modif.Client.App_id}
+	if moved {
+		from.remove(modif.Client)
+		modif.Client.Name = modif.NewName
+		modif.Client.CType = modif.NewType
+		modif.Client.App_id = modif.NewAppID
+		if modif.NewAddr != "" {
+			modif.Client.Addr = modif.NewAddr
+		}
+		to.add(modif.Client)
+	} else {
+		clog.Warn("Hub", "Newrole", "Client %s is not registered", modif.Client.Name)
+	}
+	if to != from {
+		to.mu.Unlock()
+	}
+	from.mu.Unlock()
+
+	if moved {
+		h.renamed(before, modif.Client)
 	}
-	delete(h.FullUsersList[modif.Client.CType], modif.Client.Name)
-	modif.Client.Name = modif.NewName
-	modif.Client.CType = modif.NewType
-	h.FullUsersList[modif.NewType][modif.NewName] = modif.Client
 }
 
 func (h *Hub) broadcast(message *Message) {
-	list := h.FullUsersList[message.UserType]
-	for _, client := range list {
-		select {
-		case client.Send <- message.Content:
-			h.SentMessByTicks++
+	content := message.Content
+	if message.History {
+		seq := h.nextSeq()
+		content = []byte(fmt.Sprintf("[BCST]%d|%s", seq, message.Content))
+		h.keep(TenantName(message.AppID, ""), seq, content)
+	}
+	h.fanout(message.UserType, message.History, message.AppID, content)
+}
+
+// TopicList returns the topics having at least one local subscriber, qualified by App_id.
+func (h *Hub) TopicList() []string {
+	h.topicsMutex.RLock()
+	defer h.topicsMutex.RUnlock()
+
+	list := make([]string, 0, len(h.Topics))
+	for topic := range h.Topics {
+		list = append(list, topic)
+	}
+	return list
+}
+
+// BroadcastTopic is the interest key of the users broadcasts of an App_id
+// (see InterestList), it can't collide with a client topic.
+const BroadcastTopic = "$broadcast"
+
+// InterestList returns TopicList and, for each App_id having local users,
+// TenantName(app_id, BroadcastTopic): what the brothers must forward here.
+func (h *Hub) InterestList() []string {
+	list := h.TopicList()
+	apps := make(map[string]bool)
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for app_id := range s.tenants {
+			apps[app_id] = true
+		}
+		s.mu.RUnlock()
+	}
+	for app_id := range apps {
+		list = append(list, TenantName(app_id, BroadcastTopic))
+	}
+	return list
+}
+
+// announceTopics sends the local interest set to the brother servers.
+func (h *Hub) announceTopics() {
+	json, _ := json.Marshal(h.InterestList())
+	mess := NewMessage(ClientServer, nil, append([]byte("[TPCS]"), json...))
+	h.broadcast(mess)
+}
+
+func (h *Hub) subscribe(sub *Subscription) {
+	if !h.isRegistered(sub.Client) {
+		return
+	}
+
+	key := TenantName(sub.Client.App_id, sub.Topic)
+	h.topicsMutex.Lock()
+	newTopic := h.Topics[key] == nil
+	if newTopic {
+		h.Topics[key] = make(map[string]*Client)
+	}
+	if h.subscriptions[sub.Client.ID] == nil {
+		h.subscriptions[sub.Client.ID] = make(map[string]bool)
+	}
+	h.Topics[key][sub.Client.ID] = sub.Client
+	h.subscriptions[sub.Client.ID][key] = true
+	h.topicsMutex.Unlock()
+
+	clog.Debug("Hub", "subscribe", "Client %s subscribed to %s", sub.Client.Name, sub.Topic)
+	if newTopic {
+		h.announceTopics()
+	}
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	h.removeSubscription(sub.Client, TenantName(sub.Client.App_id, sub.Topic))
+}
+
+func (h *Hub) removeSubscription(client *Client, key string) {
+	h.topicsMutex.Lock()
+	if h.Topics[key] == nil {
+		h.topicsMutex.Unlock()
+		return
+	}
+	delete(h.Topics[key], client.ID)
+	lastOne := len(h.Topics[key]) == 0
+	if lastOne {
+		delete(h.Topics, key)
+	}
+	delete(h.subscriptions[client.ID], key)
+	if len(h.subscriptions[client.ID]) == 0 {
+		delete(h.subscriptions, client.ID)
+	}
+	h.topicsMutex.Unlock()
+
+	clog.Debug("Hub", "unsubscribe", "Client %s unsubscribed from %s", client.Name, key)
+	if lastOne {
+		h.announceTopics()
+	}
+}
+
+func (h *Hub) publish(message *Message) {
+	key := TenantName(message.AppID, message.Topic)
+	seq := h.nextSeq()
+	content := []byte(fmt.Sprintf("[PUBL]%s|%d|%s", message.Topic, seq, message.Content))
+	h.keep(key, seq, content)
+
+	h.topicsMutex.RLock()
+	defer h.topicsMutex.RUnlock()
+	for _, client := range h.Topics[key] {
+		if h.deliver(client, content) {
+			atomic.AddInt64(&h.sent, 1)
 		}
 	}
 }
 
+// unicast runs in the hub goroutine, so that the destination can't be
+// unregistered, and its Send closed, during the delivery.
 func (h *Hub) unicast(message *Message) {
-	message.Dest.Send <- message.Content
+	if message.Dest == nil || !h.isRegistered(message.Dest) {
+		clog.Debug("Hub", "unicast", "Destination of %s is gone", message.Content)
+		return
+	}
 	clog.Debug("Hub", "unicast", "Unicast Message to %s : %s", message.Dest.Name, message.Content)
-	h.SentMessByTicks++
+	if h.deliver(message.Dest, message.Content) {
+		atomic.AddInt64(&h.sent, 1)
+	}
 }
 
 func (h *Hub) action(message *Message) {
@@ -198,7 +560,29 @@ func (h *Hub) action(message *Message) {
 	message.Dest.CallToAction(message.Dest, message.Content)
 }
 
+func (h *Hub) list(req *ClientsRequest) {
+	list := make([]*Client, 0, h.Count(req.CType))
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for _, client := range s.clients[req.CType] {
+			list = append(list, client)
+		}
+		s.mu.RUnlock()
+	}
+	req.Reply <- list
+}
+
+// Clients returns the clients of type ctype registered when the hub handles the request.
+func (h *Hub) Clients(ctype int) []*Client {
+	req := &ClientsRequest{CType: ctype, Reply: make(chan []*Client, 1)}
+	h.List <- req
+	return <-req.Reply
+}
+
 func (h *Hub) Run() {
+	atomic.StoreInt32(&h.running, 1)
+	defer close(h.stopped)
+
 	for {
 		select {
 		case client := <-h.Register:
@@ -211,8 +595,21 @@ func (h *Hub) Run() {
 		// 	h.updateStatus(message)
 		case message := <-h.Broadcast:
 			h.broadcast(message)
+		case sub := <-h.Subscribe:
+			h.subscribe(sub)
+		case sub := <-h.Unsubscribe:
+			h.unsubscribe(sub)
+		case message := <-h.Publish:
+			h.publish(message)
+		case req := <-h.Replay:
+			h.replay(req)
+		case req := <-h.List:
+			h.list(req)
+		case <-h.barrier:
+		case modif := <-h.newroles:
+			h.newrole(modif)
 		case message := <-h.Unicast:
-			go h.unicast(message)
+			h.unicast(message)
 		case message := <-h.Action:
 			go h.action(message)
 		case <-h.Done:
@@ -3,7 +3,10 @@ package hub
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Djoulzy/Tools/clog"
 	"github.com/stretchr/testify/assert"
@@ -50,6 +53,36 @@ func TestUnregister(t *testing.T) {
 	tmpHub.Register <- tmpClient3
 }
 
+func TestUnregisterWithoutWriter(t *testing.T) {
+	client := newClient("writerless", ClientServer)
+	client.Quit = make(chan bool) // Nobody reads it, the writer is gone
+	tmpHub.Register <- client
+
+	done := make(chan bool)
+	go func() {
+		tmpHub.Unregister <- client
+		done <- tmpHub.GetClientByName(client.Name, client.CType) == nil
+	}()
+	select {
+	case unregistered := <-done:
+		assert.True(t, unregistered, "Client should be unregistered")
+	case <-time.After(time.Second):
+		t.Fatal("Hub should not wait for a dead writer")
+	}
+}
+
+func TestUnicastToGone(t *testing.T) {
+	client := newClient("unicasted", ClientUser)
+	tmpHub.Register <- client
+	tmpHub.Unicast <- NewMessage(ClientUser, client, []byte("hello"))
+	assert.Equal(t, "hello", string(<-client.Send))
+
+	tmpHub.Unregister <- client
+	tmpHub.Unicast <- NewMessage(ClientUser, client, []byte("late"))
+	tmpHub.Unicast <- NewMessage(ClientUser, nil, []byte("nowhere"))
+	assert.Nil(t, tmpHub.GetClientByName(client.Name, ClientUser), "Hub should survive unicasts to gone clients")
+}
+
 func TestConcurrency(t *testing.T) {
 	var tmpClient *Client
 
@@ -113,6 +146,237 @@ func TestNewRole(t *testing.T) {
 	assert.Nil(t, tmpHub.GetClientByName("0", ClientUser))
 }
 
+func TestNewRoleSupersede(t *testing.T) {
+	first := newClient("superseded", ClientUser)
+	tmpHub.Register <- first
+	tmpHub.Subscribe <- &Subscription{Client: first, Topic: "room1"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tmpHub.Replay <- &ReplayRequest{Client: first, LastSeq: 0}
+		}(i)
+	}
+	second := newClient("superseding", ClientUndefined)
+	tmpHub.Register <- second
+	tmpHub.Newrole(&ConnModifier{Client: second, NewName: "superseded", NewType: ClientUser})
+	wg.Wait()
+
+	assert.Equal(t, second, tmpHub.GetClientByName("superseded", ClientUser), "Newer client should hold the name")
+	assert.Equal(t, SupersededReason, first.Reason)
+	assert.Equal(t, true, <-first.Quit, "Superseded client should be told to quit")
+}
+
+func TestTopics(t *testing.T) {
+	sub := newClient("TopicSubscriber", ClientUser)
+	other := newClient("TopicOther", ClientUser)
+
+	tmpHub.Register <- sub
+	tmpHub.Register <- other
+	tmpHub.Subscribe <- &Subscription{Client: sub, Topic: "room1"}
+	tmpHub.Publish <- NewTopicMessage("", "room1", []byte("PUBLISH"))
+
+	message, ok := <-sub.Send
+	if ok {
+		assert.Equal(t, true, strings.HasPrefix(string(message), "[PUBL]room1|"), "Bad topic frame")
+		assert.Equal(t, true, strings.HasSuffix(string(message), "|PUBLISH"), "Message cannot be read from channel")
+	} else {
+		t.Fail()
+	}
+
+	tmpHub.Newrole(&ConnModifier{Client: sub, NewName: "TopicRenamed", NewType: ClientUser})
+	tmpHub.Publish <- NewTopicMessage("", "room1", []byte("RENAMED"))
+
+	message, ok = <-sub.Send
+	if ok {
+		assert.Equal(t, true, strings.HasSuffix(string(message), "|RENAMED"), "Subscription should survive a Newrole")
+	} else {
+		t.Fail()
+	}
+	assert.Equal(t, 0, len(other.Send), "Only subscribers should receive the message")
+}
+
+func TestTopicsCleanup(t *testing.T) {
+	h := NewHub()
+	client := newClient("TopicCleanup", ClientUser)
+
+	h.register(client)
+	h.subscribe(&Subscription{Client: client, Topic: "room1"})
+	h.subscribe(&Subscription{Client: client, Topic: "room2"})
+	assert.Equal(t, 2, len(h.Topics), "Bad number of topics")
+
+	h.unsubscribe(&Subscription{Client: client, Topic: "room1"})
+	assert.Nil(t, h.Topics["room1"], "Empty topic should be removed")
+
+	h.unregister(client)
+	assert.Equal(t, 0, len(h.Topics), "Topics should be cleaned on unregister")
+	assert.Equal(t, 0, len(h.subscriptions), "Subscriptions should be cleaned on unregister")
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHub()
+	h.HistorySize = 2
+	client := newClient("HistoryUser", ClientUser)
+	h.register(client)
+	h.subscribe(&Subscription{Client: client, Topic: "room1"})
+
+	h.broadcast(NewHistoryMessage("", []byte("one")))
+	h.publish(NewTopicMessage("", "room1", []byte("two")))
+	h.broadcast(NewHistoryMessage("", []byte("three")))
+	h.broadcast(NewHistoryMessage("", []byte("four")))
+
+	assert.Equal(t, "[BCST]1|one", string(<-client.Send), "Bad broadcast frame")
+	assert.Equal(t, "[PUBL]room1|2|two", string(<-client.Send), "Bad topic frame")
+	assert.Equal(t, "[BCST]3|three", string(<-client.Send), "Bad broadcast frame")
+	assert.Equal(t, "[BCST]4|four", string(<-client.Send), "Bad broadcast frame")
+
+	h.replay(&ReplayRequest{Client: client, LastSeq: 1})
+	assert.Equal(t, "[PUBL]room1|2|two", string(<-client.Send), "Bad replayed frame")
+	assert.Equal(t, "[BCST]3|three", string(<-client.Send), "Bad replayed frame")
+	assert.Equal(t, "[BCST]4|four", string(<-client.Send), "Bad replayed frame")
+	assert.Equal(t, "[RPLY]4", string(<-client.Send), "Replay should end with the current sequence")
+	assert.Equal(t, 0, len(client.Send), "Nothing more should be replayed")
+
+	h.replay(&ReplayRequest{Client: client, LastSeq: 4})
+	assert.Equal(t, "[RPLY]4", string(<-client.Send), "Nothing should be replayed")
+
+	for len(client.Send) < cap(client.Send)-2 {
+		client.Send <- []byte("pending")
+	}
+	h.replay(&ReplayRequest{Client: client, LastSeq: 1})
+	for len(client.Send) > 2 {
+		<-client.Send
+	}
+	assert.Equal(t, "[PUBL]room1|2|two", string(<-client.Send), "Replay should fill the free space")
+	assert.Equal(t, "[RPLY]2", string(<-client.Send), "Short replay should end with the last frame sent")
+
+	for len(client.Send) < cap(client.Send) {
+		client.Send <- []byte("pending")
+	}
+	h.replay(&ReplayRequest{Client: client, LastSeq: 1})
+	for len(client.Send) > 1 {
+		<-client.Send
+	}
+	assert.Equal(t, "[RPLY]1", string(<-client.Send), "Full buffer should still get an answer")
+	assert.Equal(t, int64(1), client.Drops(), "Frame making room for the answer should be counted")
+}
+
+func TestTenants(t *testing.T) {
+	h := NewHub()
+	userA := newClient("incomming1", ClientUndefined)
+	userB := newClient("incomming2", ClientUndefined)
+	h.register(userA)
+	h.register(userB)
+	h.Newrole(&ConnModifier{Client: userA, NewName: TenantName("appA", "bob"), NewType: ClientUser, NewAppID: "appA"})
+	h.Newrole(&ConnModifier{Client: userB, NewName: TenantName("appB", "bob"), NewType: ClientUser, NewAppID: "appB"})
+
+	assert.Equal(t, 2, h.Count(ClientUser), "Same name in two apps should not collide")
+	assert.Equal(t, 1, h.TenantSize("appA"), "Bad tenant size")
+	app_id, name := SplitTenantName(userA.Name)
+	assert.Equal(t, "appA", app_id)
+	assert.Equal(t, "bob", name)
+
+	h.subscribe(&Subscription{Client: userA, Topic: "room1"})
+	h.subscribe(&Subscription{Client: userB, Topic: "room1"})
+	h.broadcast(NewHistoryMessage("appA", []byte("hello")))
+	h.publish(NewTopicMessage("appB", "room1", []byte("news")))
+
+	assert.Equal(t, "[BCST]1|hello", string(<-userA.Send), "Bad broadcast frame")
+	assert.Equal(t, "[PUBL]room1|2|news", string(<-userB.Send), "Topic name should not be qualified in frames")
+	assert.Equal(t, 0, len(userA.Send), "Topic messages should stay in their app")
+	assert.Equal(t, 0, len(userB.Send), "Broadcasts should stay in their app")
+
+	h.replay(&ReplayRequest{Client: userB, LastSeq: 0})
+	assert.Equal(t, "[PUBL]room1|2|news", string(<-userB.Send), "Bad replayed frame")
+	assert.Equal(t, "[RPLY]2", string(<-userB.Send), "Broadcasts of other apps should not be replayed")
+
+	h.unregister(userA)
+	assert.Equal(t, 0, h.TenantSize("appA"), "Tenant should be cleaned on unregister")
+	for _, s := range h.shards {
+		assert.Nil(t, s.tenants["appA"], "Empty tenant should be removed")
+	}
+}
+
+func TestBroadcastInterest(t *testing.T) {
+	h := NewHub()
+	brother := newClient("brother", ClientServer)
+	user := newClient("incomming", ClientUndefined)
+	h.register(brother)
+	h.register(user)
+
+	h.Newrole(&ConnModifier{Client: user, NewName: TenantName("appA", "bob"), NewType: ClientUser, NewAppID: "appA"})
+	assert.Contains(t, h.InterestList(), TenantName("appA", BroadcastTopic), "App with local users should be advertised")
+	assert.Equal(t, "[TPCS][\"appA/$broadcast\"]", string(<-brother.Send), "First user of an app should be announced")
+
+	h.unregister(user)
+	assert.Equal(t, "[TPCS][]", string(<-brother.Send), "Last user of an app leaving should be announced")
+	assert.False(t, ValidName(BroadcastTopic), "Broadcast interest key should be reserved")
+}
+
+func TestClients(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	defer func() { h.Done <- true }()
+
+	h.Register <- newClient("clients1", ClientUndefined)
+	h.Register <- newClient("clients2", ClientUndefined)
+
+	list := h.Clients(ClientUndefined)
+	assert.Equal(t, 2, len(list), "Registered clients should be listed")
+	assert.Equal(t, 0, len(h.Clients(ClientUser)), "Only the requested type should be listed")
+}
+
+func TestOverflow(t *testing.T) {
+	h := NewHub()
+	h.Overflow[ClientUser] = OverflowDropOldest
+	h.Overflow[ClientMonitor] = OverflowDisconnect
+
+	newest := newClient("newest", ClientUndefined)
+	newest.Send = make(chan []byte, 1)
+	oldest := newClient("oldest", ClientUser)
+	oldest.Send = make(chan []byte, 1)
+	h.register(newest)
+	h.register(oldest)
+
+	h.broadcast(NewMessage(ClientUndefined, nil, []byte("first")))
+	h.broadcast(NewMessage(ClientUndefined, nil, []byte("second")))
+	assert.Equal(t, "first", string(<-newest.Send), "Newest message should be dropped")
+	assert.Equal(t, int64(1), newest.Drops(), "Drop should be counted")
+
+	h.broadcast(NewMessage(ClientUser, nil, []byte("first")))
+	h.broadcast(NewMessage(ClientUser, nil, []byte("second")))
+	assert.Equal(t, "second", string(<-oldest.Send), "Oldest message should be dropped")
+	assert.Equal(t, int64(1), oldest.Drops(), "Drop should be counted")
+	assert.Equal(t, int64(2), h.Dropped(), "Hub should count every drop")
+
+	policy, err := ParseOverflow(" Disconnect ")
+	assert.Nil(t, err)
+	assert.Equal(t, OverflowDisconnect, policy)
+	_, err = ParseOverflow("wait")
+	assert.Equal(t, ErrBadOverflow, err)
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	h := NewHub()
+	h.Overflow[ClientMonitor] = OverflowDisconnect
+	go h.Run()
+	defer func() { h.Done <- true }()
+
+	slow := newClient("slow", ClientMonitor)
+	slow.Send = make(chan []byte, 1)
+	h.Register <- slow
+	h.Broadcast <- NewMessage(ClientMonitor, nil, []byte("first"))
+	h.Broadcast <- NewMessage(ClientMonitor, nil, []byte("second"))
+
+	for i := 0; i < 100 && len(h.Clients(ClientMonitor)) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, len(h.Clients(ClientMonitor)), "Slow client should be disconnected")
+	assert.Equal(t, "Too slow", slow.Reason)
+}
+
 func TestMain(m *testing.M) {
 	clog.LogLevel = 5
 	clog.StartLogging = false
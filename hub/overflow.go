@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Djoulzy/Tools/clog"
+)
+
+// What the hub does when the Send buffer of a client is full.
+const (
+	OverflowDropNewest = 0 // The new message is lost
+	OverflowDropOldest = 1 // The oldest queued message is lost
+	OverflowDisconnect = 2 // The client is unregistered
+)
+
+var OverflowName = [3]string{"dropnewest", "dropoldest", "disconnect"}
+
+var ErrBadOverflow = errors.New("hub: unknown overflow policy")
+
+// ParseOverflow reads a policy name as found in the config : dropnewest,
+// dropoldest or disconnect.
+func ParseOverflow(name string) (int, error) {
+	for policy, policyName := range OverflowName {
+		if strings.EqualFold(strings.TrimSpace(name), policyName) {
+			return policy, nil
+		}
+	}
+	return OverflowDropNewest, ErrBadOverflow
+}
+
+// Drops returns the number of messages lost by the client since its connection.
+func (c *Client) Drops() int64 {
+	return atomic.LoadInt64(&c.drops)
+}
+
+// Dropped returns the number of messages lost by slow clients since start.
+func (h *Hub) Dropped() int64 {
+	var dropped int64
+	for _, s := range h.shards {
+		dropped += atomic.LoadInt64(&s.dropped)
+	}
+	return dropped
+}
+
+func (s *shard) drop(client *Client) {
+	atomic.AddInt64(&client.drops, 1)
+	atomic.AddInt64(&s.dropped, 1)
+}
+
+// deliver queues content for a client without ever blocking the hub loop.
+// A full Send buffer is handled by the overflow policy of the client type.
+func (h *Hub) deliver(client *Client, content []byte) bool {
+	return h.deliverFrom(h.shardOf(client.Name), client, content)
+}
+
+// deliverFrom is deliver for a client of shard s.
+func (h *Hub) deliverFrom(s *shard, client *Client, content []byte) bool {
+	select {
+	case client.Send <- content:
+		return true
+	default:
+	}
+
+	switch h.Overflow[client.CType] {
+	case OverflowDropOldest:
+		select {
+		case <-client.Send:
+		default:
+		}
+		s.drop(client)
+		select {
+		case client.Send <- content:
+			return true
+		default:
+		}
+	case OverflowDisconnect:
+		s.drop(client)
+		if atomic.CompareAndSwapInt32(&client.overflowed, 0, 1) {
+			clog.Warn("Hub", "deliver", "Client %s is too slow, disconnecting", client.Name)
+			client.Reason = "Too slow"
+			go func() { h.Unregister <- client }()
+		}
+		return false
+	default:
+		s.drop(client)
+	}
+	return false
+}
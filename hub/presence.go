@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"sort"
+	"strings"
+)
+
+// PresenceTopic is the topic to subscribe to ([SUBS]$presence) to receive the
+// presence events of the users of the same App_id :
+// [PEVT]join|<name>, [PEVT]leave|<name> and [PEVT]rename|<old_name>|<new_name>.
+const PresenceTopic = "$presence"
+
+// Topics starting with ReservedTopicPrefix are fed by the hub only, clients
+// can subscribe to them but not publish.
+const ReservedTopicPrefix = "$"
+
+func IsReservedTopic(topic string) bool {
+	return strings.HasPrefix(topic, ReservedTopicPrefix)
+}
+
+// Presence returns the names of the users of app_id connected to this hub, sorted.
+func (h *Hub) Presence(app_id string) []string {
+	names := []string{}
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for qualified := range s.tenants[app_id] {
+			_, name := SplitTenantName(qualified)
+			names = append(names, name)
+		}
+		s.mu.RUnlock()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// presenceEvent sends an event to the presence subscribers of app_id.
+func (h *Hub) presenceEvent(app_id string, event string) {
+	content := []byte("[PEVT]" + event)
+
+	h.topicsMutex.RLock()
+	defer h.topicsMutex.RUnlock()
+	for _, client := range h.Topics[TenantName(app_id, PresenceTopic)] {
+		h.deliver(client, content)
+	}
+}
+
+// The brothers are told when an App_id gets its first user, or loses its
+// last one, so that they only forward its broadcasts where needed.
+func (h *Hub) joined(client *Client) {
+	if client.CType == ClientUser {
+		_, name := SplitTenantName(client.Name)
+		h.presenceEvent(client.App_id, "join|"+name)
+		if h.TenantSize(client.App_id) == 1 {
+			h.announceTopics()
+		}
+	}
+}
+
+func (h *Hub) left(client *Client) {
+	if client.CType == ClientUser {
+		_, name := SplitTenantName(client.Name)
+		h.presenceEvent(client.App_id, "leave|"+name)
+		if h.TenantSize(client.App_id) == 0 {
+			h.announceTopics()
+		}
+		if h.OnLeave != nil {
+			go h.OnLeave(client)
+		}
+	}
+}
+
+// renamed sends the events of a Newrole, before is a copy of the client
+// taken before the change.
+func (h *Hub) renamed(before Client, client *Client) {
+	if before.CType != ClientUser || client.CType != ClientUser || before.App_id != client.App_id {
+		h.left(&before)
+		h.joined(client)
+		return
+	}
+	if before.Name != client.Name {
+		_, old_name := SplitTenantName(before.Name)
+		_, name := SplitTenantName(client.Name)
+		h.presenceEvent(client.App_id, "rename|"+old_name+"|"+name)
+	}
+}
@@ -0,0 +1,40 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresence(t *testing.T) {
+	h := NewShardedHub(4)
+
+	watcher := newClient(TenantName("appA", "watcher"), ClientUser)
+	watcher.App_id = "appA"
+	h.register(watcher)
+	h.subscribe(&Subscription{Client: watcher, Topic: PresenceTopic})
+
+	other := newClient(TenantName("appB", "other"), ClientUser)
+	other.App_id = "appB"
+	h.register(other)
+
+	bob := newClient("bob", ClientUndefined)
+	h.register(bob)
+	h.Newrole(&ConnModifier{Client: bob, NewName: TenantName("appA", "bob"), NewType: ClientUser, NewAppID: "appA"})
+	assert.Equal(t, "[PEVT]join|bob", string(<-watcher.Send), "Login should be a join")
+	assert.Equal(t, []string{"bob", "watcher"}, h.Presence("appA"))
+	assert.Equal(t, []string{"other"}, h.Presence("appB"), "Presence should be scoped by App_id")
+
+	h.Newrole(&ConnModifier{Client: bob, NewName: TenantName("appA", "robert"), NewType: ClientUser, NewAppID: "appA"})
+	assert.Equal(t, "[PEVT]rename|bob|robert", string(<-watcher.Send))
+
+	leaving := make(chan *Client, 1)
+	h.OnLeave = func(c *Client) { leaving <- c }
+	h.unregister(bob)
+	assert.Equal(t, "[PEVT]leave|robert", string(<-watcher.Send))
+	assert.Equal(t, bob, <-leaving, "OnLeave should be called with the user")
+	assert.Equal(t, []string{"watcher"}, h.Presence("appA"))
+
+	assert.Equal(t, 0, len(watcher.Send), "Other applications should not be seen")
+	assert.Equal(t, 0, len(other.Send), "Events should go to subscribers only")
+}
@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// shard holds the clients whose name hashes to it. It is written by the hub
+// goroutine (and Newrole) and may be read from any goroutine.
+type shard struct {
+	mu      sync.RWMutex
+	clients [4](map[string]*Client)
+
+	// Users of each application, indexed by App_id then by name.
+	tenants map[string](map[string]*Client)
+
+	sent    int64
+	dropped int64
+}
+
+func newShard() *shard {
+	s := &shard{tenants: make(map[string](map[string]*Client))}
+	for ctype := range s.clients {
+		s.clients[ctype] = make(map[string]*Client)
+	}
+	return s
+}
+
+// add must be called with mu held.
+func (s *shard) add(client *Client) {
+	s.clients[client.CType][client.Name] = client
+	if client.CType != ClientUser {
+		return
+	}
+	if s.tenants[client.App_id] == nil {
+		s.tenants[client.App_id] = make(map[string]*Client)
+	}
+	s.tenants[client.App_id][client.Name] = client
+}
+
+// remove must be called with mu held.
+func (s *shard) remove(client *Client) {
+	delete(s.clients[client.CType], client.Name)
+	if client.CType != ClientUser || s.tenants[client.App_id] == nil {
+		return
+	}
+	delete(s.tenants[client.App_id], client.Name)
+	if len(s.tenants[client.App_id]) == 0 {
+		delete(s.tenants, client.App_id)
+	}
+}
+
+func (s *shard) lookup(name string, ctype int) *Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clients[ctype][name]
+}
+
+// fanout delivers content to the clients of ctype, or to the users of app_id
+// when tenant is set.
+func (s *shard) fanout(h *Hub, ctype int, tenant bool, app_id string, content []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := s.clients[ctype]
+	if tenant {
+		list = s.tenants[app_id]
+	}
+	for _, client := range list {
+		if h.deliverFrom(s, client, content) {
+			atomic.AddInt64(&s.sent, 1)
+		}
+	}
+}
+
+// shardOf returns the shard of a client name.
+func (h *Hub) shardOf(name string) *shard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return h.shards[hash.Sum32()%uint32(len(h.shards))]
+}
+
+// lookup is the unsynchronized GetClientByName, for the hub goroutine.
+func (h *Hub) lookup(name string, ctype int) *Client {
+	return h.shardOf(name).lookup(name, ctype)
+}
+
+func (h *Hub) isRegistered(client *Client) bool {
+	found := h.lookup(client.Name, client.CType)
+	return found != nil && found.ID == client.ID
+}
+
+// fanout runs the delivery of a message on every shard at once.
+func (h *Hub) fanout(ctype int, tenant bool, app_id string, content []byte) {
+	if len(h.shards) == 1 {
+		h.shards[0].fanout(h, ctype, tenant, app_id, content)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(h.shards))
+	for _, s := range h.shards {
+		go func(s *shard) {
+			s.fanout(h, ctype, tenant, app_id, content)
+			wg.Done()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// sync waits for the hub goroutine to handle the requests already sent to it,
+// so that a lookup made after a send to Register or Unregister sees its result.
+func (h *Hub) sync() {
+	if atomic.LoadInt32(&h.running) == 0 {
+		return
+	}
+	select {
+	case h.barrier <- true:
+	case <-h.stopped:
+	}
+}
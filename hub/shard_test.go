@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShards(t *testing.T) {
+	h := NewShardedHub(8)
+	for i := 0; i < 100; i++ {
+		h.register(newClient(fmt.Sprintf("sharded%d", i), ClientUser))
+	}
+	assert.Equal(t, 100, h.Count(ClientUser), "Clients should be spread, not lost")
+
+	used := 0
+	for _, s := range h.shards {
+		if len(s.clients[ClientUser]) > 0 {
+			used++
+		}
+	}
+	assert.Equal(t, 8, used, "Every shard should hold clients")
+
+	client := h.lookup("sharded1", ClientUser)
+	h.Newrole(&ConnModifier{Client: client, NewName: "moved", NewType: ClientUser})
+	assert.Nil(t, h.lookup("sharded1", ClientUser), "Old name should be released")
+	assert.Equal(t, client, h.lookup("moved", ClientUser), "Client should be found in its new shard")
+
+	h.broadcast(NewMessage(ClientUser, nil, []byte("hello")))
+	assert.Equal(t, "hello", string(<-client.Send), "Broadcast should reach every shard")
+	assert.Equal(t, 100, h.SentMessages(), "Deliveries of all shards should be counted")
+}
+
+func TestConcurrentReads(t *testing.T) {
+	h := NewShardedHub(4)
+	go h.Run()
+	defer func() { h.Done <- true }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("reader%d-%d", i, j)
+				h.Register <- newClient(name, ClientUser)
+				assert.True(t, h.UserExists(name, ClientUser), "Lookup should see the registration")
+				h.Count(ClientUser)
+				h.TenantSize("")
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 200, h.Count(ClientUser))
+}
+
+// benchClients returns n users with the Send buffer of a connection, each
+// drained by a goroutine as the writer of a connection does.
+func benchClients(b *testing.B, n int) []*Client {
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = newClient(fmt.Sprintf("bench%d", i), ClientUser)
+		go func(c *Client) {
+			for range c.Send {
+			}
+		}(clients[i])
+	}
+	b.Cleanup(func() {
+		for _, c := range clients {
+			close(c.Send)
+		}
+	})
+	return clients
+}
+
+// legacyHub is the registry of the hub before sharding, one map walked by
+// the hub goroutine, kept as the baseline of the broadcast benchmarks.
+type legacyHub struct {
+	users map[string]*Client
+	sent  int64
+}
+
+func (h *legacyHub) broadcast(content []byte) {
+	for _, client := range h.users {
+		select {
+		case client.Send <- content:
+			h.sent++
+		default:
+		}
+	}
+}
+
+func benchmarkBroadcastBaseline(b *testing.B, n int) {
+	h := &legacyHub{users: make(map[string]*Client)}
+	for _, client := range benchClients(b, n) {
+		h.users[client.Name] = client
+	}
+	content := []byte("BROADCAST")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.broadcast(content)
+	}
+}
+
+// benchmarkBroadcast measures the fan-out of one broadcast to n users. A
+// single shard walks the clients from the hub goroutine only, the sharded
+// hub gets one shard by CPU as with NewHub.
+func benchmarkBroadcast(b *testing.B, shards int, n int) {
+	h := NewShardedHub(shards)
+	for _, client := range benchClients(b, n) {
+		h.register(client)
+	}
+	message := NewMessage(ClientUser, nil, []byte("BROADCAST"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.broadcast(message)
+	}
+}
+
+func BenchmarkBroadcast10kBaseline(b *testing.B)  { benchmarkBroadcastBaseline(b, 10000) }
+func BenchmarkBroadcast10kOneShard(b *testing.B)  { benchmarkBroadcast(b, 1, 10000) }
+func BenchmarkBroadcast10kSharded(b *testing.B)   { benchmarkBroadcast(b, runtime.NumCPU(), 10000) }
+func BenchmarkBroadcast100kBaseline(b *testing.B) { benchmarkBroadcastBaseline(b, 100000) }
+func BenchmarkBroadcast100kOneShard(b *testing.B) { benchmarkBroadcast(b, 1, 100000) }
+func BenchmarkBroadcast100kSharded(b *testing.B)  { benchmarkBroadcast(b, runtime.NumCPU(), 100000) }
+
+// benchmarkRegister measures the registration then unregistration of one
+// user by a hub already holding n users.
+func benchmarkRegister(b *testing.B, shards int, n int) {
+	h := NewShardedHub(shards)
+	for _, client := range benchClients(b, n) {
+		h.register(client)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := newClient(fmt.Sprintf("joining%d", i), ClientUser)
+		h.register(client)
+		h.unregister(client)
+	}
+}
+
+func BenchmarkRegister10kOneShard(b *testing.B)  { benchmarkRegister(b, 1, 10000) }
+func BenchmarkRegister10kSharded(b *testing.B)   { benchmarkRegister(b, runtime.NumCPU(), 10000) }
+func BenchmarkRegister100kOneShard(b *testing.B) { benchmarkRegister(b, 1, 100000) }
+func BenchmarkRegister100kSharded(b *testing.B)  { benchmarkRegister(b, runtime.NumCPU(), 100000) }
@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"sort"
+	"time"
+)
+
+// ClientInfo describes a registered client at the time of a Snapshot.
+type ClientInfo struct {
+	Name       string
+	CType      int
+	App_id     string
+	Addr       string
+	User_agent string
+	Since      time.Time
+	Drops      int64
+}
+
+// Snapshot is a consistent copy of the hub registry, safe to read from any goroutine.
+type Snapshot struct {
+	Counts  [4]int         // Clients by type, see Client*
+	Apps    map[string]int // Users by App_id
+	Clients []ClientInfo   // Sorted by type then name
+	Topics  []string
+	Sent    int
+	Dropped int64
+}
+
+// Snapshot copies the registry under the shards locks, once the hub has
+// applied the registrations it already received.
+func (h *Hub) Snapshot() *Snapshot {
+	h.sync()
+	snap := &Snapshot{Apps: make(map[string]int)}
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for ctype, list := range s.clients {
+			snap.Counts[ctype] += len(list)
+			for _, client := range list {
+				snap.Clients = append(snap.Clients, ClientInfo{
+					Name:       client.Name,
+					CType:      client.CType,
+					App_id:     client.App_id,
+					Addr:       client.Addr,
+					User_agent: client.User_agent,
+					Since:      client.Since,
+					Drops:      client.Drops(),
+				})
+			}
+		}
+		for app_id, users := range s.tenants {
+			snap.Apps[app_id] += len(users)
+		}
+		s.mu.RUnlock()
+	}
+
+	sort.Slice(snap.Clients, func(i, j int) bool {
+		if snap.Clients[i].CType != snap.Clients[j].CType {
+			return snap.Clients[i].CType < snap.Clients[j].CType
+		}
+		return snap.Clients[i].Name < snap.Clients[j].Name
+	})
+	snap.Topics = h.TopicList()
+	snap.Sent = h.SentMessages()
+	snap.Dropped = h.Dropped()
+	return snap
+}
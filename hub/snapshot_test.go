@@ -0,0 +1,48 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	h := NewShardedHub(4)
+	go h.Run()
+	defer func() { h.Done <- true }()
+
+	monitor := newClient("SnapMonitor", ClientMonitor)
+	h.Register <- monitor
+	for i := 0; i < 3; i++ {
+		user := newClient(fmt.Sprintf("snap%d", i), ClientUndefined)
+		h.Register <- user
+		h.Newrole(&ConnModifier{Client: user, NewName: TenantName("appA", user.Name), NewType: ClientUser, NewAppID: "appA"})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			h.Register <- newClient(fmt.Sprintf("busy%d", i), ClientUndefined)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		h.Snapshot()
+	}
+	wg.Wait()
+
+	snap := h.Snapshot()
+	assert.Equal(t, 3, snap.Counts[ClientUser], "Bad users count")
+	assert.Equal(t, 1, snap.Counts[ClientMonitor], "Bad monitors count")
+	assert.Equal(t, 50, snap.Counts[ClientUndefined], "Bad incomming count")
+	assert.Equal(t, 3, snap.Apps["appA"], "Bad app count")
+	assert.Equal(t, 54, len(snap.Clients), "Every client should be described")
+
+	last := snap.Clients[len(snap.Clients)-1]
+	assert.Equal(t, "SnapMonitor", last.Name, "Clients should be sorted by type")
+	assert.Equal(t, "Test Socket", last.User_agent)
+	assert.False(t, last.Since.IsZero(), "Registration time should be set")
+}
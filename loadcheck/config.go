@@ -40,7 +40,6 @@ type TCPServerConfig struct {
 type Encryption struct {
 	HASH_SIZE int
 	HEX_KEY   string
-	HEX_IV    string
 }
 
 type AppConfig struct {
@@ -84,6 +83,5 @@ var conf *AppConfig = &AppConfig{
 	Encryption{
 		HASH_SIZE: 8,
 		HEX_KEY:   "0000000000000000000000000000000000000000000000000000000000000000",
-		HEX_IV:    "00000000000000000000000000000000",
 	},
 }
@@ -69,7 +69,7 @@ func TryRedirect(c *Conn, addr string) {
 	wg.Add(1)
 	go connect(c.name, u)
 	wg.Wait()
-	connString, _ := cryptor.Encrypt_b64(fmt.Sprintf("LOAD_%d|wmsa_BR|USER", c.name))
+	connString, _ := cryptor.NewHandshake(fmt.Sprintf("LOAD_%d", c.name), "wmsa_BR", "USER", addr)
 	Clients[c.name].send <- append([]byte("[HELO]"), []byte(connString)...)
 }
 
@@ -166,7 +166,6 @@ func main() {
 	cryptor = &urlcrypt.Cypher{
 		HASH_SIZE: conf.HASH_SIZE,
 		HEX_KEY:   []byte(conf.HEX_KEY),
-		HEX_IV:    []byte(conf.HEX_IV),
 	}
 
 	for i := 0; i < 1000; i++ {
@@ -175,8 +174,8 @@ func main() {
 		wg.Wait()
 		// duration := time.Second / 100
 		// time.Sleep(duration)
-		passPhrase := fmt.Sprintf("LOAD_%d|wmsa_BR|USER", i)
-		connString, _ := cryptor.Encrypt_b64(passPhrase)
+		passPhrase := fmt.Sprintf("LOAD_%d", i)
+		connString, _ := cryptor.NewHandshake(passPhrase, "wmsa_BR", "USER", conf.HTTPaddr)
 		clog.Debug("test_load", "main", "Connecting %s [%s] ...", passPhrase, connString)
 		Clients[i].send <- append([]byte("[HELO]"), []byte(connString)...)
 	}
@@ -1,146 +1,499 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/protocol"
+	"github.com/Djoulzy/Polycom/urlcrypt"
 	"github.com/Djoulzy/Tools/clog"
 )
 
-func welcomeNewMonitor(c *hub.Client, newName string, app_id string) {
-	if len(zeHub.Monitors) >= conf.MaxMonitorsConns {
-		zeHub.Unregister <- c
-		// <-c.Consistent
-	} else {
-		zeHub.Newrole(&hub.ConnModifier{Client: c, NewName: c.Name, NewType: hub.ClientMonitor})
-		c.App_id = app_id
-		clog.Info("server", "welcomeNewMonitor", "Accepting %s", c.Name)
+// Handshake reject reasons, sent as [RJCT]<reason> before disconnecting.
+const (
+	RejectBadToken  = "BADTOKEN"
+	RejectBadFormat = "BADFORMAT"
+	RejectExpired   = "EXPIRED"
+	RejectReplayed  = "REPLAYED"
+	RejectWrongDest = "WRONGDEST"
+	RejectBadType   = "BADTYPE"
+	RejectFull      = "FULL"
+	RejectUnknown   = "UNKNOWN"
+	RejectDuplicate = "DUPLICATE"
+)
+
+// rejectClient returns protocol.ErrClosed, nothing can be sent to c afterwards.
+func rejectClient(c *hub.Client, reason string) error {
+	clog.Warn("server", "rejectClient", "Rejecting %s: %s", c.Name, reason)
+	c.Send <- []byte("[RJCT]" + reason)
+	zeHub.Unregister <- c
+	return protocol.ErrClosed
+}
+
+func welcomeNewMonitor(c *hub.Client, newName string, app_id string) error {
+	if zeHub.Count(hub.ClientMonitor) >= currentConf().MaxMonitorsConns {
+		return rejectClient(c, RejectFull)
+	}
+	zeHub.Newrole(&hub.ConnModifier{Client: c, NewName: c.Name, NewType: hub.ClientMonitor, NewAppID: app_id})
+	clog.Info("server", "welcomeNewMonitor", "Accepting %s", c.Name)
+	return nil
+}
+
+// appUsersLimit returns the maximum number of users of app_id, 0 meaning no limit.
+func appUsersLimit(app_id string) int {
+	cfg := currentConf()
+	if limit, err := strconv.Atoi(cfg.Apps[app_id]); err == nil {
+		return limit
 	}
+	return cfg.MaxUsersConnsPerApp
 }
 
-func welcomeNewUser(c *hub.Client, newName string, app_id string) {
+// Users are registered under hub.TenantName(app_id, name), so that each
+// application has its own users namespace.
+func welcomeNewUser(c *hub.Client, newName string, app_id string) error {
 	if zeHub.UserExists(c.Name, hub.ClientUndefined) {
-		if len(zeHub.Users) >= conf.MaxUsersConns && !zeHub.UserExists(newName, hub.ClientUser) {
-			clog.Warn("server", "welcomeNewUser", "Too many Users connections, rejecting %s (In:%d/Cl:%d).", c.Name, len(zeHub.Incomming), len(zeHub.Users))
+		newName = hub.TenantName(app_id, newName)
+		exists := zeHub.UserExists(newName, hub.ClientUser)
+		limit := appUsersLimit(app_id)
+		if zeHub.Count(hub.ClientUser) >= currentConf().MaxUsersConns && !exists {
+			clog.Warn("server", "welcomeNewUser", "Too many Users connections, rejecting %s (In:%d/Cl:%d).", c.Name, zeHub.Count(hub.ClientUndefined), zeHub.Count(hub.ClientUser))
 			if !ScaleList.RedirectConnection(c) {
 				clog.Error("server", "welcomeNewUser", "NO FREE SLOTS !!!")
 			}
-			zeHub.Unregister <- c
-			// <-c.Consistent
+			return rejectClient(c, RejectFull)
+		} else if limit > 0 && zeHub.TenantSize(app_id) >= limit && !exists {
+			clog.Warn("server", "welcomeNewUser", "Too many Users connections for app %s, rejecting %s (%d/%d).", app_id, c.Name, zeHub.TenantSize(app_id), limit)
+			if !ScaleList.RedirectConnection(c) {
+				clog.Error("server", "welcomeNewUser", "NO FREE SLOTS for app %s !!!", app_id)
+			}
+			return rejectClient(c, RejectFull)
 		} else {
 			clog.Info("server", "welcomeNewUser", "Identifying %s as %s", c.Name, newName)
-			zeHub.Newrole(&hub.ConnModifier{Client: c, NewName: newName, NewType: hub.ClientUser})
-			c.App_id = app_id
-			ScaleList.DispatchNewConnection(zeHub, c.Name)
+			ScaleList.OpenSession(c, newName, app_id)
 		}
 	} else {
 		clog.Warn("server", "welcomeNewUser", "Can't identify client... Disconnecting %s.", c.Name)
-		zeHub.Unregister <- c
-		// <-c.Consistent
+		return rejectClient(c, RejectUnknown)
 	}
+	return nil
 }
 
-func welcomeNewServer(c *hub.Client, newName string, addr string) {
-	if len(zeHub.Servers) >= conf.MaxServersConns {
-		clog.Warn("server", "welcomeNewServer", "Too many Server connections, rejecting %s (In:%d/Cl:%d).", c.Name, len(zeHub.Incomming), len(zeHub.Servers))
-		zeHub.Unregister <- c
-		// <-c.Consistent
-		return
+func welcomeNewServer(c *hub.Client, newName string, addr string) error {
+	if zeHub.Count(hub.ClientServer) >= currentConf().MaxServersConns {
+		clog.Warn("server", "welcomeNewServer", "Too many Server connections, rejecting %s (In:%d/Cl:%d).", c.Name, zeHub.Count(hub.ClientUndefined), zeHub.Count(hub.ClientServer))
+		return rejectClient(c, RejectFull)
 	}
 
 	if zeHub.UserExists(c.Name, hub.ClientUndefined) {
 		clog.Info("server", "welcomeNewServer", "Identifying %s as %s", c.Name, newName)
-		zeHub.Newrole(&hub.ConnModifier{Client: c, NewName: newName, NewType: hub.ClientServer})
-		c.Addr = addr
+		if !ScaleList.IdentifyLink(c, newName, addr) {
+			return rejectClient(c, RejectDuplicate)
+		}
 		ScaleList.AddNewConnectedServer(c)
+
+		topics, _ := json.Marshal(zeHub.InterestList())
+		mess := hub.NewMessage(hub.ClientServer, c, append([]byte("[TPCS]"), topics...))
+		zeHub.Unicast <- mess
 	} else {
 		clog.Warn("server", "welcomeNewServer", "Can't identify server... Disconnecting %s.", c.Name)
-		zeHub.Unregister <- c
-		// <-c.Consistent
+		return rejectClient(c, RejectUnknown)
 	}
+	return nil
 }
 
-func HandShake(c *hub.Client, message []byte) {
-	uncrypted_message, _ := Cryptor.Decrypt_b64(string(message))
+// HandShake checks a [HELO] token : <name>|<app_id ou addr_ip>|<client_type>|<issue_timestamp>|<nonce>|<target>
+// Tokens older than TokenTTL, whose nonce was already seen, or made for another
+// server (target is the HTTPaddr or TCPaddr of the server) are refused.
+// Legacy v0 tokens (see AcceptLegacyTokens) are <name>|<app_id ou addr_ip>|<client_type>
+// and have no expiry nor replay protection.
+// The token can be followed by the framing wanted by the client : [HELO]<token>|json
+// (or |textid to keep the text form with message ids)
+func HandShake(c *hub.Client, message []byte) ([]byte, error) {
+	if i := bytes.IndexByte(message, '|'); i >= 0 {
+		framing, err := protocol.ParseFraming(string(message[i+1:]))
+		if err != nil {
+			return nil, rejectClient(c, RejectBadFormat)
+		}
+		c.Framing = framing
+		message = message[:i]
+	}
+
+	uncrypted_message, err := Cryptor.Decrypt_b64(string(message))
+	if err != nil {
+		switch err {
+		case urlcrypt.ErrBadKey:
+			clog.Error("server", "HandShake", "Cannot decrypt handshake of %s, check HEX_KEY: %s", c.Name, err)
+		case urlcrypt.ErrBadSignature:
+			clog.Warn("server", "HandShake", "Forged or corrupted handshake from %s (%s): %s", c.Name, c.Addr, err)
+		default:
+			clog.Warn("server", "HandShake", "Unreadable handshake from %s (%s): %s", c.Name, c.Addr, err)
+		}
+		return nil, rejectClient(c, RejectBadToken)
+	}
 	clog.Info("server", "HandShake", "New Incomming Client %s (%s)", c.Name, uncrypted_message)
 	infos := strings.Split(string(uncrypted_message), "|")
-	if len(infos) != 3 {
+	switch {
+	case len(infos) == 3 && urlcrypt.IsLegacy(string(message)):
+		clog.Debug("server", "HandShake", "Legacy token from %s, no expiry nor replay check", c.Name)
+	case len(infos) == 6:
+		if target := infos[5]; target != currentConf().HTTPaddr && target != currentConf().TCPaddr {
+			clog.Warn("server", "HandShake", "Token of %s (%s) was made for %s", c.Name, c.Addr, target)
+			return nil, rejectClient(c, RejectWrongDest)
+		}
+		issued, err := strconv.ParseInt(infos[3], 10, 64)
+		if err != nil {
+			return nil, rejectClient(c, RejectBadFormat)
+		}
+		age := time.Since(time.Unix(issued, 0))
+		ttl := time.Duration(currentConf().TokenTTL) * time.Second
+		if age > ttl || age < -ttl {
+			return nil, rejectClient(c, RejectExpired)
+		}
+		if !Nonces.Use(infos[4]) {
+			return nil, rejectClient(c, RejectReplayed)
+		}
+	default:
 		clog.Warn("server", "HandShake", "Bad Handshake format ... Disconnecting")
-		zeHub.Unregister <- c
-		// <-c.Consistent
-		return
+		return nil, rejectClient(c, RejectBadFormat)
 	}
 
 	App_id := strings.TrimSpace(infos[1])
 	newName := strings.TrimSpace(infos[0])
 	switch infos[2] {
 	case "MNTR":
-		welcomeNewMonitor(c, newName, App_id)
+		return nil, welcomeNewMonitor(c, newName, App_id)
 	case "SERV":
-		welcomeNewServer(c, newName, App_id)
+		return nil, welcomeNewServer(c, newName, App_id)
 	case "USER":
-		welcomeNewUser(c, newName, App_id)
+		// The app_id is the prefix of the user names, see hub.TenantName
+		if !hub.ValidName(App_id) || !hub.ValidName(newName) {
+			return nil, rejectClient(c, RejectBadFormat)
+		}
+		return nil, welcomeNewUser(c, newName, App_id)
 	default:
-		zeHub.Unregister <- c
-		// <-c.Consistent
+		return nil, rejectClient(c, RejectBadType)
+	}
+}
+
+// [UCST]<dest_name>|<payload>
+// The destination is looked for among the users of the sender's application.
+func unicastToUser(c *hub.Client, action_group []byte) ([]byte, error) {
+	infos := bytes.SplitN(action_group, []byte("|"), 2)
+	if len(infos) != 2 || len(infos[0]) == 0 || !hub.ValidName(string(infos[0])) {
+		return nil, protocol.ErrBadPayload
+	}
+
+	dest := hub.TenantName(c.App_id, string(infos[0]))
+	if user := zeHub.GetClientByName(dest, hub.ClientUser); user != nil {
+		zeHub.Unicast <- hub.NewMessage(hub.ClientUser, user, infos[1])
+		return nil, nil
+	}
+
+	brother := ScaleList.GetUserLocation(dest)
+	if brother != nil {
+		clog.Debug("server", "unicastToUser", "Forwarding unicast for %s to %s", dest, brother.Name)
+		mess := hub.NewMessage(hub.ClientServer, brother, []byte(fmt.Sprintf("[UCFW]%s|%s|%s", c.Name, dest, infos[1])))
+		zeHub.Unicast <- mess
+		return nil, nil
+	}
+
+	clog.Warn("server", "unicastToUser", "Unknown destination %s for %s", dest, c.Name)
+	return nil, protocol.ErrNotFound
+}
+
+// [UCFW]<sender_name>|<dest_name>|<payload>
+func forwardedUnicast(c *hub.Client, action_group []byte) ([]byte, error) {
+	infos := bytes.SplitN(action_group, []byte("|"), 3)
+	if len(infos) != 3 {
+		return nil, protocol.ErrBadPayload
+	}
+
+	dest := string(infos[1])
+	if user := zeHub.GetClientByName(dest, hub.ClientUser); user != nil {
+		zeHub.Unicast <- hub.NewMessage(hub.ClientUser, user, infos[2])
+	} else {
+		mess := hub.NewMessage(hub.ClientServer, c, []byte(fmt.Sprintf("[UCNF]%s|%s", infos[0], dest)))
+		zeHub.Unicast <- mess
+	}
+	return nil, nil
+}
+
+// [UCNF]<sender_name>|<dest_name>
+func unicastNotFound(c *hub.Client, action_group []byte) ([]byte, error) {
+	infos := strings.SplitN(string(action_group), "|", 2)
+	if len(infos) != 2 {
+		return nil, protocol.ErrBadPayload
+	}
+
+	ScaleList.ForgetUser(infos[1], c)
+	_, dest := hub.SplitTenantName(infos[1])
+	for _, ctype := range []int{hub.ClientUser, hub.ClientMonitor} {
+		if sender := zeHub.GetClientByName(infos[0], ctype); sender != nil {
+			zeHub.Unicast <- hub.NewMessage(ctype, sender, []byte(fmt.Sprintf("[UCST]%s:?", dest)))
+			break
+		}
+	}
+	return nil, nil
+}
+
+// [PUBL]<topic>|<payload>
+// Between servers : [PUBL]<app_id>|<topic>|<payload>
+// Topics reserved to the hub ($presence) can't be published to.
+func publishToTopic(c *hub.Client, action_group []byte) ([]byte, error) {
+	app_id := c.App_id
+	if c.CType == hub.ClientServer {
+		infos := bytes.SplitN(action_group, []byte("|"), 2)
+		if len(infos) != 2 {
+			return nil, protocol.ErrBadPayload
+		}
+		app_id, action_group = string(infos[0]), infos[1]
+	}
+
+	infos := bytes.SplitN(action_group, []byte("|"), 2)
+	if len(infos) != 2 || len(infos[0]) == 0 {
+		return nil, protocol.ErrBadPayload
+	}
+
+	topic := string(infos[0])
+	if !hub.ValidName(topic) {
+		return nil, protocol.ErrBadPayload
+	}
+	if hub.IsReservedTopic(topic) {
+		return nil, protocol.ErrForbidden
 	}
+	mess := hub.NewTopicMessage(app_id, topic, infos[1])
+	zeHub.Publish <- mess
+	if c.CType != hub.ClientServer {
+		relay := []byte(fmt.Sprintf("[PUBL]%s|%s|%s", app_id, topic, infos[1]))
+		ScaleList.PublishToBrothers(hub.TenantName(app_id, topic), relay)
+	}
+	return nil, nil
+}
+
+// [BCST]<payload>, sent to the users of the sender's application.
+// Between servers : [BCST]<app_id>|<payload>
+func broadcastToApp(c *hub.Client, action_group []byte) ([]byte, error) {
+	if c.CType == hub.ClientServer {
+		infos := bytes.SplitN(action_group, []byte("|"), 2)
+		if len(infos) != 2 {
+			return nil, protocol.ErrBadPayload
+		}
+		mess := hub.NewHistoryMessage(string(infos[0]), infos[1])
+		zeHub.Broadcast <- mess
+		return nil, nil
+	}
+
+	mess := hub.NewHistoryMessage(c.App_id, action_group)
+	zeHub.Broadcast <- mess
+	relay := []byte(fmt.Sprintf("[BCST]%s|%s", c.App_id, action_group))
+	ScaleList.PublishToBrothers(hub.TenantName(c.App_id, hub.BroadcastTopic), relay)
+	return nil, nil
+}
+
+// [SUBS]<topic>
+func subscribeToTopic(c *hub.Client, action_group []byte) ([]byte, error) {
+	if !hub.ValidName(string(action_group)) {
+		return nil, protocol.ErrBadPayload
+	}
+	zeHub.Subscribe <- &hub.Subscription{Client: c, Topic: string(action_group)}
+	return nil, nil
+}
+
+// [UNSB]<topic>
+func unsubscribeFromTopic(c *hub.Client, action_group []byte) ([]byte, error) {
+	if !hub.ValidName(string(action_group)) {
+		return nil, protocol.ErrBadPayload
+	}
+	zeHub.Unsubscribe <- &hub.Subscription{Client: c, Topic: string(action_group)}
+	return nil, nil
+}
+
+// [RPLY]<last_seq>
+func replayHistory(c *hub.Client, action_group []byte) ([]byte, error) {
+	lastSeq, err := strconv.ParseUint(string(action_group), 10, 64)
+	if err != nil {
+		return nil, protocol.ErrBadPayload
+	}
+	zeHub.Replay <- &hub.ReplayRequest{Client: c, LastSeq: lastSeq}
+	return nil, nil
+}
+
+// [STOR]<json>
+func storeRecord(c *hub.Client, action_group []byte) ([]byte, error) {
+	return nil, Store.NewRecord(c.App_id, string(action_group))
+}
+
+// [QUIT]
+func quit(c *hub.Client, action_group []byte) ([]byte, error) {
+	zeHub.Unregister <- c
+	return nil, protocol.ErrClosed
+}
+
+// [TPCS]<json_interest_list>, see hub.InterestList
+func updateTopics(c *hub.Client, action_group []byte) ([]byte, error) {
+	ScaleList.UpdateTopics(c.Addr, action_group)
+	return nil, nil
+}
+
+// [MNIT]<json_metrics>
+func updateMetrics(c *hub.Client, action_group []byte) ([]byte, error) {
+	clog.Debug("server", "updateMetrics", "Metrics received from %s (%s)", c.Name, c.Addr)
+	ScaleList.UpdateMetrics(c.Addr, action_group)
+	return nil, nil
+}
+
+// [KILL]<user_name>
+// Monitors can only kill users of their app.
+func killUser(c *hub.Client, action_group []byte) ([]byte, error) {
+	id := hub.TenantName(c.App_id, string(action_group))
+	if userToKill := zeHub.GetClientByName(id, hub.ClientUser); userToKill != nil {
+		clog.Info("server", "killUser", "Killing user %s", action_group)
+		zeHub.Unregister <- userToKill
+	}
+	return nil, nil
+}
+
+// [SESS]<name>|<version>, a login on a brother.
+func sessionClaim(c *hub.Client, action_group []byte) ([]byte, error) {
+	infos := strings.SplitN(string(action_group), "|", 2)
+	if len(infos) != 2 {
+		return nil, protocol.ErrBadPayload
+	}
+	version, err := strconv.ParseUint(infos[1], 10, 64)
+	if err != nil {
+		return nil, protocol.ErrBadPayload
+	}
+	if superseded := ScaleList.ClaimSession(infos[0], version, c); superseded != nil {
+		closeSuperseded(c, superseded)
+	}
+	return nil, nil
+}
+
+// closeSuperseded disconnects a local user logged in again on a brother.
+func closeSuperseded(c *hub.Client, user *hub.Client) {
+	clog.Info("server", "closeSuperseded", "User %s logged in on %s, closing local session", user.Name, c.Name)
+	user.Reason = hub.SupersededReason
+	zeHub.Unregister <- user
+}
+
+// [SDIR]<json_sessions_digest>
+func sessionsDigest(c *hub.Client, action_group []byte) ([]byte, error) {
+	superseded, err := ScaleList.SyncSessions(c, action_group)
+	if err != nil {
+		return nil, protocol.ErrBadPayload
+	}
+	for _, user := range superseded {
+		closeSuperseded(c, user)
+	}
+	return nil, nil
+}
+
+var (
+	anyClient     = []int{hub.ClientUser, hub.ClientServer, hub.ClientMonitor}
+	usersMonitors = []int{hub.ClientUser, hub.ClientMonitor}
+	serversOnly   = []int{hub.ClientServer}
+	monitorsOnly  = []int{hub.ClientMonitor}
+)
+
+// registerCommands declares the core verbs of the protocol.
+func registerCommands(r *protocol.Router) {
+	commands := []*protocol.Command{
+		{Verb: "[HELO]", Handler: HandShake, ClientTypes: []int{hub.ClientUndefined}, NoHandshake: true},
+		{Verb: "[BCST]", Handler: broadcastToApp, ClientTypes: anyClient},
+		{Verb: "[UCST]", Handler: unicastToUser, ClientTypes: usersMonitors, MinPayload: 2},
+		{Verb: "[UCFW]", Handler: forwardedUnicast, ClientTypes: serversOnly, MinPayload: 3},
+		{Verb: "[UCNF]", Handler: unicastNotFound, ClientTypes: serversOnly, MinPayload: 2},
+		{Verb: "[SUBS]", Handler: subscribeToTopic, ClientTypes: usersMonitors, MinPayload: 1},
+		{Verb: "[UNSB]", Handler: unsubscribeFromTopic, ClientTypes: usersMonitors, MinPayload: 1},
+		{Verb: "[PUBL]", Handler: publishToTopic, ClientTypes: anyClient, MinPayload: 2},
+		{Verb: "[RPLY]", Handler: replayHistory, ClientTypes: usersMonitors, MinPayload: 1},
+		{Verb: "[STOR]", Handler: storeRecord, ClientTypes: []int{hub.ClientUser}},
+		{Verb: "[QUIT]", Handler: quit, ClientTypes: anyClient},
+		{Verb: "[TPCS]", Handler: updateTopics, ClientTypes: serversOnly},
+		{Verb: "[MNIT]", Handler: updateMetrics, ClientTypes: serversOnly},
+		{Verb: "[KILL]", Handler: killUser, ClientTypes: monitorsOnly, MinPayload: 1},
+		{Verb: "[SESS]", Handler: sessionClaim, ClientTypes: serversOnly, MinPayload: 3},
+		{Verb: "[SDIR]", Handler: sessionsDigest, ClientTypes: serversOnly, MinPayload: 2},
+		{Verb: "[RLOD]", Handler: reloadCommand, ClientTypes: monitorsOnly},
+		{Verb: "[PRES]", Handler: presenceList, ClientTypes: usersMonitors},
+		{Verb: "[PRSQ]", Handler: presenceQuery, ClientTypes: serversOnly, MinPayload: 2},
+		{Verb: "[PRSR]", Handler: presenceResult, ClientTypes: serversOnly, MinPayload: 3},
+	}
+	for _, cmd := range commands {
+		if err := r.Handle(cmd); err != nil {
+			clog.Error("server", "registerCommands", "Cannot register %s: %s", cmd.Verb, err)
+		}
+	}
+}
+
+func reply(c *hub.Client, content []byte) {
+	mess := hub.NewMessage(c.CType, c, content)
+	zeHub.Unicast <- mess
+}
+
+// legacyReply returns the error reply sent to clients not using message ids.
+func legacyReply(c *hub.Client, frame *protocol.Frame, err error) []byte {
+	switch err {
+	case protocol.ErrForbidden:
+		return []byte("[DENY]" + frame.Verb)
+	case protocol.ErrNotFound:
+		target := bytes.SplitN(frame.Body(), []byte("|"), 2)[0]
+		return []byte(fmt.Sprintf("%s%s:?", frame.Verb, target))
+	case protocol.ErrUnknownVerb:
+		return []byte(frame.Verb + ":?")
+	}
+	if c.CType == hub.ClientServer {
+		return nil
+	}
+	return []byte(frame.Verb + ":?")
 }
 
+// CallToAction runs the commands of the clients. Commands sent with a
+// message id (by clients which asked for a framing at [HELO]) are answered by [ACK_]#<id>|<response> or [NACK]#<id>|<error_code>.
 func CallToAction(c *hub.Client, message []byte) {
-	if len(message) < 6 {
-		clog.Warn("server", "CallToAction", "Bad Command '%s', disconnecting client %s.", message, c.Name)
+	frame, err := protocol.Decode(message, protocol.AcceptsIDs(c.Framing))
+	if err != nil {
+		clog.Warn("server", "CallToAction", "Bad Command '%s', disconnecting client %s: %s", message, c.Name, err)
 		zeHub.Unregister <- c
-		// <-c.Consistent
 		return
 	}
 
-	cmd_group := string(message[0:6])
-	action_group := message[6:]
-
-	if c.CType != hub.ClientUndefined {
-		switch cmd_group {
-		case "[BCST]":
-			mess := hub.NewMessage(hub.ClientUser, nil, action_group)
-			zeHub.Broadcast <- mess
-			if c.CType != hub.ClientServer {
-				mess = hub.NewMessage(hub.ClientServer, nil, message)
-				zeHub.Broadcast <- mess
-			}
-		case "[UCST]":
-		case "[STOR]":
-			Storage.NewRecord(string(action_group))
-		case "[QUIT]":
-			zeHub.Unregister <- c
-			// <-c.Consistent
-		case "[MNIT]":
-			clog.Debug("server", "CallToAction", "Metrics received from %s (%s)", c.Name, c.Addr)
-			ScaleList.UpdateMetrics(c.Addr, action_group)
-		case "[KILL]":
-			id := string(action_group)
-			if zeHub.UserExists(id, hub.ClientUser) {
-				userToKill := zeHub.Users[id]
-				clog.Info("server", "CallToAction", "Killing user %s", action_group)
-				zeHub.Unregister <- userToKill
-				// <-userToKill.Consistent
-			}
-		case "[GKEY]":
-			crypted, _ := Cryptor.Encrypt_b64(string(action_group))
-			mess := hub.NewMessage(c.CType, c, crypted)
-			zeHub.Unicast <- mess
-		default:
-			mess := hub.NewMessage(c.CType, c, []byte(fmt.Sprintf("%s:?", cmd_group)))
-			zeHub.Unicast <- mess
+	response, err := Commands.DispatchFrame(c, frame)
+	switch err {
+	case nil:
+		if frame.ID != "" {
+			reply(c, protocol.Ack(frame.ID, response))
+		} else if response != nil {
+			reply(c, response)
 		}
-	} else {
-		switch cmd_group {
-		case "[HELO]":
-			// [HELO]<unique_id>|<app_id ou addr_ip>|<client_type>
-			HandShake(c, action_group)
-		default:
-			clog.Warn("server", "CallToAction", "Bad Command '%s', disconnecting client %s.", cmd_group, c.Name)
+		return
+	case protocol.ErrClosed:
+		return
+	case protocol.ErrHandshakeMissing:
+		clog.Warn("server", "CallToAction", "Bad Command '%s', disconnecting client %s.", frame.Verb, c.Name)
+		zeHub.Unregister <- c
+		return
+	case protocol.ErrUnknownVerb:
+		if c.CType == hub.ClientUndefined {
+			clog.Warn("server", "CallToAction", "Bad Command '%s', disconnecting client %s.", frame.Verb, c.Name)
 			zeHub.Unregister <- c
-			// <-c.Consistent
+			return
 		}
+	case protocol.ErrForbidden:
+		Perms.Deny(c, frame.Verb)
+	case protocol.ErrNotFound:
+	default:
+		clog.Warn("server", "CallToAction", "Command %s from %s failed: %s", frame.Verb, c.Name, err)
+	}
+
+	if frame.ID != "" {
+		reply(c, protocol.Nack(frame.ID, err))
+	} else if content := legacyReply(c, frame, err); content != nil {
+		reply(c, content)
 	}
 }
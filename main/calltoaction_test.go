@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/monitoring"
+	"github.com/Djoulzy/Polycom/nettools/httpserver"
+	"github.com/Djoulzy/Polycom/nettools/scaling"
+	"github.com/Djoulzy/Polycom/nettools/tcpserver"
+	"github.com/Djoulzy/Polycom/protocol"
+	"github.com/Djoulzy/Polycom/urlcrypt"
+	"github.com/Djoulzy/Tools/clog"
+	"github.com/stretchr/testify/assert"
+)
+
+const legacyToken = "BGtRlX8Awlkp6Myq07_hpw/QvGzLgBaPZiJgeKdpfg7HZzBhEaspxOJaCBv-05d96k" // iphone1|xcode|USER
+
+func newIncomming(name string) *hub.Client {
+	c := &hub.Client{Name: name, CType: hub.ClientUndefined, Send: make(chan []byte, 8), Quit: make(chan bool, 8)}
+	zeHub.Register <- c
+	return c
+}
+
+func TestHandShakeLegacy(t *testing.T) {
+	c := newIncomming("legacy1")
+	Cryptor.AcceptLegacy = false
+	HandShake(c, []byte(legacyToken))
+	assert.Equal(t, "[RJCT]"+RejectBadToken, string(<-c.Send), "Legacy tokens should be refused by default")
+
+	Cryptor.AcceptLegacy = true
+	defer func() { Cryptor.AcceptLegacy = false }()
+	c = newIncomming("legacy2")
+	assert.Nil(t, handshakeErr(HandShake(c, []byte(legacyToken))))
+	assert.True(t, zeHub.UserExists("xcode/iphone1", hub.ClientUser), "Legacy token should identify the user")
+
+	short, _ := Cryptor.Encrypt_b64("bob|xcode|USER")
+	c = newIncomming("short")
+	HandShake(c, short)
+	assert.Equal(t, "[RJCT]"+RejectBadFormat, string(<-c.Send), "Only v0 tokens can omit the issue time and nonce")
+
+	token, _ := Cryptor.NewHandshake("alice", "xcode", "USER", conf.HTTPaddr)
+	c = newIncomming("current")
+	assert.Nil(t, handshakeErr(HandShake(c, token)))
+	assert.True(t, zeHub.UserExists("xcode/alice", hub.ClientUser))
+
+	c = newIncomming("replay")
+	HandShake(c, token)
+	assert.Equal(t, "[RJCT]"+RejectReplayed, string(<-c.Send))
+
+	token, _ = Cryptor.NewHandshake("alice", "xcode", "USER", "brother:8080")
+	c = newIncomming("elsewhere")
+	HandShake(c, token)
+	assert.Equal(t, "[RJCT]"+RejectWrongDest, string(<-c.Send), "Token made for a brother should be refused")
+}
+
+func TestHandShakeAppID(t *testing.T) {
+	token, _ := Cryptor.NewHandshake("bob", "x/code", "USER", conf.HTTPaddr)
+	c := newIncomming("slashed")
+	HandShake(c, token)
+	assert.Equal(t, "[RJCT]"+RejectBadFormat, string(<-c.Send), "App_id with a / would be mistaken when split")
+	assert.False(t, zeHub.UserExists("x/code/bob", hub.ClientUser))
+
+	token, _ = Cryptor.NewHandshake("appA/bob", "", "USER", conf.HTTPaddr)
+	c = newIncomming("impostor")
+	HandShake(c, token)
+	assert.Equal(t, "[RJCT]"+RejectBadFormat, string(<-c.Send), "User name with a / would take the place of a user of another app")
+}
+
+func TestTenantIsolation(t *testing.T) {
+	c := newIncomming("isolated")
+	zeHub.Newrole(&hub.ConnModifier{Client: c, NewName: "eve", NewType: hub.ClientUser})
+
+	_, err := unicastToUser(c, []byte("appA/bob|hello"))
+	assert.Equal(t, protocol.ErrBadPayload, err, "Users of other apps should not be reachable")
+	_, err = subscribeToTopic(c, []byte("appA/room1"))
+	assert.Equal(t, protocol.ErrBadPayload, err, "Topics of other apps should not be reachable")
+	_, err = publishToTopic(c, []byte("appA/room1|hello"))
+	assert.Equal(t, protocol.ErrBadPayload, err, "Topics of other apps should not be reachable")
+}
+
+func handshakeErr(response []byte, err error) error {
+	return err
+}
+
+func TestMain(m *testing.M) {
+	clog.LogLevel = 5
+	clog.StartLogging = false
+
+	conf.HEX_KEY = "d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473"
+	Cryptor = &urlcrypt.Cypher{
+		HASH_SIZE: 8,
+		HEX_KEY:   []byte(conf.HEX_KEY),
+	}
+	Nonces = urlcrypt.NewNonceCache(2 * time.Duration(conf.TokenTTL) * time.Second)
+	zeHub = hub.NewHub()
+	go zeHub.Run()
+	ScaleList = scaling.Init(&tcpserver.Manager{ServerName: "Test", Hub: zeHub}, nil)
+	HTTPManager = &httpserver.Manager{}
+	MonParams = &monitoring.Params{}
+
+	os.Exit(m.Run())
+}
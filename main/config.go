@@ -1,19 +1,31 @@
 package main
 
+import "sync"
+
 type ServerID struct {
 	Name string
 }
 
 type Globals struct {
-	LogLevel     int
-	StartLogging bool
+	LogLevel        int
+	StartLogging    bool
+	ShutdownTimeOut int
 }
 
 type ConnectionLimit struct {
-	MaxUsersConns     int
-	MaxMonitorsConns  int
-	MaxServersConns   int
-	MaxIncommingConns int
+	MaxUsersConns       int
+	MaxMonitorsConns    int
+	MaxServersConns     int
+	MaxIncommingConns   int
+	MaxUsersConnsPerApp int
+}
+
+type AppLimits struct {
+	Apps map[string]string
+}
+
+type AppPermissions struct {
+	Commands map[string]string
 }
 
 type ServersAddresses struct {
@@ -30,43 +42,94 @@ type HTTPServerConfig struct {
 	WriteBufferSize  int
 	NBAcceptBySecond int
 	HandshakeTimeout int
+	CertFile         string
+	KeyFile          string
+	StatusUser       string
+	StatusPassword   string
 }
 
 type TCPServerConfig struct {
 	ConnectTimeOut           int
 	WriteTimeOut             int
+	ReadTimeOut              int
+	PingPeriod               int
+	MaxLineLength            int
 	ScalingCheckServerPeriod int
+	MeshCertFile             string
+	MeshKeyFile              string
+	MeshCAFile               string
 }
 
 type Encryption struct {
-	HASH_SIZE int
-	HEX_KEY   string
-	HEX_IV    string
+	HASH_SIZE          int
+	HEX_KEY            string
+	AcceptLegacyTokens bool
+	TokenTTL           int
+	CurrentKeyID       string
+	RetiredKeyIDs      string
+}
+
+type Keyring struct {
+	Keys map[string]string
+}
+
+type Storage struct {
+	Backend             string
+	FilePath            string
+	KafkaBrokers        string
+	KafkaTopic          string
+	KafkaTopicPerApp    bool
+	KafkaKeyStrategy    string
+	KafkaAcks           string
+	KafkaCompression    string
+	KafkaFlushMessages  int
+	KafkaFlushFrequency int
+}
+
+type History struct {
+	HistorySize int
+}
+
+type SlowConsumers struct {
+	IncommingOverflow string
+	UsersOverflow     string
+	ServersOverflow   string
+	MonitorsOverflow  string
 }
 
 type AppConfig struct {
 	ServerID
 	Globals
 	ConnectionLimit
+	AppLimits
+	AppPermissions
 	ServersAddresses
 	KnownBrothers
 	HTTPServerConfig
 	TCPServerConfig
 	Encryption
+	Keyring
+	Storage
+	History
+	SlowConsumers
 }
 
 var conf *AppConfig = &AppConfig{
 	ServerID{},
 	Globals{
-		LogLevel:     4,
-		StartLogging: true,
+		LogLevel:        4,
+		StartLogging:    true,
+		ShutdownTimeOut: 10,
 	},
 	ConnectionLimit{
-		MaxUsersConns:     100,
-		MaxMonitorsConns:  3,
-		MaxServersConns:   5,
-		MaxIncommingConns: 50,
+		MaxUsersConns:       100,
+		MaxMonitorsConns:    3,
+		MaxServersConns:     5,
+		MaxIncommingConns:   50,
+		MaxUsersConnsPerApp: 0,
 	},
+	AppLimits{},
+	AppPermissions{},
 	ServersAddresses{
 		HTTPaddr: "localhost:8080",
 		TCPaddr:  "localhost:8081",
@@ -77,15 +140,58 @@ var conf *AppConfig = &AppConfig{
 		WriteBufferSize:  4096,
 		NBAcceptBySecond: 20,
 		HandshakeTimeout: 5,
+		CertFile:         "",
+		KeyFile:          "",
 	},
 	TCPServerConfig{
 		ConnectTimeOut:           2,
 		WriteTimeOut:             1,
+		ReadTimeOut:              30,
+		PingPeriod:               10,
+		MaxLineLength:            65536,
 		ScalingCheckServerPeriod: 10,
+		MeshCertFile:             "",
+		MeshKeyFile:              "",
+		MeshCAFile:               "",
 	},
 	Encryption{
-		HASH_SIZE: 8,
-		HEX_KEY:   "0000000000000000000000000000000000000000000000000000000000000000",
-		HEX_IV:    "00000000000000000000000000000000",
+		HASH_SIZE:          8,
+		HEX_KEY:            "0000000000000000000000000000000000000000000000000000000000000000",
+		AcceptLegacyTokens: false,
+		TokenTTL:           120,
+		CurrentKeyID:       "0",
+		RetiredKeyIDs:      "",
+	},
+	Keyring{},
+	Storage{
+		Backend:             "file",
+		FilePath:            "storage.jsonl",
+		KafkaBrokers:        "localhost:9092",
+		KafkaTopic:          "polycom",
+		KafkaTopicPerApp:    false,
+		KafkaKeyStrategy:    "none",
+		KafkaAcks:           "local",
+		KafkaCompression:    "none",
+		KafkaFlushMessages:  100,
+		KafkaFlushFrequency: 500,
+	},
+	History{
+		HistorySize: 100,
 	},
+	SlowConsumers{
+		IncommingOverflow: "dropnewest",
+		UsersOverflow:     "dropnewest",
+		ServersOverflow:   "dropnewest",
+		MonitorsOverflow:  "dropoldest",
+	},
+}
+
+var confMutex sync.RWMutex
+
+// currentConf returns the running config. It is replaced as a whole by
+// reloadConfig and never modified in place, so it can be read without lock.
+func currentConf() *AppConfig {
+	confMutex.RLock()
+	defer confMutex.RUnlock()
+	return conf
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/protocol"
+	"github.com/Djoulzy/Tools/clog"
+)
+
+// Permissions narrows the client types declared by each command.
+// Users of an app_id listed in ByApp may only send the commands of that list
+// which are open to users.
+type Permissions struct {
+	ByApp  map[string]map[string]bool
+	denied int64
+}
+
+func commandSet(list []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, cmd := range list {
+		cmd = strings.Trim(strings.TrimSpace(cmd), "[]")
+		if cmd != "" {
+			set["["+cmd+"]"] = true
+		}
+	}
+	return set
+}
+
+// NewPermissions reads the [AppPermissions] section : <app_id> = <CMD>,<CMD>,...
+func NewPermissions(byApp map[string]string) *Permissions {
+	p := &Permissions{
+		ByApp: make(map[string]map[string]bool),
+	}
+	for app_id, list := range byApp {
+		p.ByApp[app_id] = commandSet(strings.Split(list, ","))
+	}
+	return p
+}
+
+// Allowed is used as the protocol.Router Authorize hook.
+func (p *Permissions) Allowed(c *hub.Client, cmd *protocol.Command) bool {
+	if c.CType == hub.ClientUser {
+		if set, ok := p.ByApp[c.App_id]; ok {
+			return set[cmd.Verb] && cmd.Allows(c.CType)
+		}
+	}
+	return cmd.Allows(c.CType)
+}
+
+func (p *Permissions) Deny(c *hub.Client, cmd string) {
+	atomic.AddInt64(&p.denied, 1)
+	clog.Warn("server", "Permissions", "Command %s denied to %s %s (%s, app %s)", cmd, hub.CTYpeName[c.CType], c.Name, c.Addr, c.App_id)
+}
+
+// Denied returns the number of refused commands since start.
+func (p *Permissions) Denied() int64 {
+	return atomic.LoadInt64(&p.denied)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermissions(t *testing.T) {
+	p := NewPermissions(map[string]string{"xcode": "BCST, [UCST],SESS"})
+	user := &hub.Client{CType: hub.ClientUser, App_id: "xcode"}
+	other := &hub.Client{CType: hub.ClientUser, App_id: "other"}
+
+	bcst := &protocol.Command{Verb: "[BCST]", ClientTypes: anyClient}
+	publ := &protocol.Command{Verb: "[PUBL]", ClientTypes: anyClient}
+	sess := &protocol.Command{Verb: "[SESS]", ClientTypes: serversOnly}
+
+	assert.True(t, p.Allowed(user, bcst))
+	assert.False(t, p.Allowed(user, publ), "Commands not listed should be refused")
+	assert.False(t, p.Allowed(user, sess), "Listing a server command should not open it to users")
+	assert.True(t, p.Allowed(other, publ), "Apps not listed should keep the default list")
+	assert.False(t, p.Allowed(other, sess))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/protocol"
+	"github.com/Djoulzy/Tools/clog"
+)
+
+// Mesh presence queries waiting for the answers of the brothers.
+var (
+	presenceQueries      = make(map[uint64]chan []string)
+	presenceQueriesMutex sync.Mutex
+	presenceQueryID      uint64
+)
+
+// [PRES]        : users of the caller's App_id connected to this server
+// [PRES]mesh    : same, including the users connected to the brothers
+// The answer is [PRES]<json_names>.
+func presenceList(c *hub.Client, action_group []byte) ([]byte, error) {
+	names := zeHub.Presence(c.App_id)
+	switch string(action_group) {
+	case "":
+	case "mesh":
+		names = meshPresence(c.App_id, names)
+	default:
+		return nil, protocol.ErrBadPayload
+	}
+	list, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("[PRES]"), list...), nil
+}
+
+// meshPresence asks the connected brothers for the users of app_id and merges
+// their answers with local. Brothers not answering in time are ignored.
+func meshPresence(app_id string, local []string) []string {
+	id := atomic.AddUint64(&presenceQueryID, 1)
+	answers := make(chan []string, ScaleList.MaxServersConns+1)
+	presenceQueriesMutex.Lock()
+	presenceQueries[id] = answers
+	presenceQueriesMutex.Unlock()
+	defer func() {
+		presenceQueriesMutex.Lock()
+		delete(presenceQueries, id)
+		presenceQueriesMutex.Unlock()
+	}()
+
+	set := make(map[string]bool)
+	for _, name := range local {
+		set[name] = true
+	}
+
+	expected := ScaleList.SendToBrothers([]byte(fmt.Sprintf("[PRSQ]%d|%s", id, app_id)))
+	timeout := time.After(time.Duration(currentConf().ConnectTimeOut) * time.Second)
+	for ; expected > 0; expected-- {
+		select {
+		case names := <-answers:
+			for _, name := range names {
+				set[name] = true
+			}
+		case <-timeout:
+			clog.Warn("server", "meshPresence", "%d brother(s) did not answer query %d", expected, id)
+			expected = 0
+		}
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// [PRSQ]<query_id>|<app_id>
+func presenceQuery(c *hub.Client, action_group []byte) ([]byte, error) {
+	infos := bytes.SplitN(action_group, []byte("|"), 2)
+	if len(infos) != 2 {
+		return nil, protocol.ErrBadPayload
+	}
+	names, _ := json.Marshal(zeHub.Presence(string(infos[1])))
+	mess := hub.NewMessage(hub.ClientServer, c, []byte(fmt.Sprintf("[PRSR]%s|%s", infos[0], names)))
+	zeHub.Unicast <- mess
+	return nil, nil
+}
+
+// [PRSR]<query_id>|<json_names>
+func presenceResult(c *hub.Client, action_group []byte) ([]byte, error) {
+	infos := bytes.SplitN(action_group, []byte("|"), 2)
+	if len(infos) != 2 {
+		return nil, protocol.ErrBadPayload
+	}
+	var id uint64
+	if _, err := fmt.Sscanf(string(infos[0]), "%d", &id); err != nil {
+		return nil, protocol.ErrBadPayload
+	}
+	var names []string
+	if err := json.Unmarshal(infos[1], &names); err != nil {
+		return nil, protocol.ErrBadPayload
+	}
+
+	presenceQueriesMutex.Lock()
+	answers := presenceQueries[id]
+	presenceQueriesMutex.Unlock()
+	if answers == nil {
+		clog.Debug("server", "presenceResult", "Late answer from %s to query %d", c.Name, id)
+		return nil, nil
+	}
+	select {
+	case answers <- names:
+	default:
+	}
+	return nil, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresenceList(t *testing.T) {
+	c := newIncomming("presence1")
+	zeHub.Newrole(&hub.ConnModifier{Client: c, NewName: hub.TenantName("presapp", "zoe"), NewType: hub.ClientUser, NewAppID: "presapp"})
+
+	response, err := presenceList(c, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "[PRES][\"zoe\"]", string(response), "Presence should be answered with its verb")
+
+	_, err = presenceList(c, []byte("nearby"))
+	assert.Equal(t, protocol.ErrBadPayload, err)
+}
+
+func TestReservedTopics(t *testing.T) {
+	c := newIncomming("presence2")
+	zeHub.Newrole(&hub.ConnModifier{Client: c, NewName: hub.TenantName("presapp", "eve"), NewType: hub.ClientUser, NewAppID: "presapp"})
+
+	_, err := publishToTopic(c, []byte(hub.PresenceTopic+"|[PEVT]join|mallory"))
+	assert.Equal(t, protocol.ErrForbidden, err, "Users should not publish to the hub topics")
+	_, err = publishToTopic(c, []byte("room1|hello"))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/urlcrypt"
+
+	"github.com/Djoulzy/Tools/clog"
+	"github.com/Djoulzy/Tools/config"
+)
+
+// newKeyring builds the urlcrypt keyring from the config. HEX_KEY is
+// always known as key "0" unless the [Keyring] section redefines it.
+func newKeyring(c *AppConfig) *urlcrypt.Keyring {
+	kr := &urlcrypt.Keyring{
+		Keys:    map[string]string{"0": c.HEX_KEY},
+		Current: c.CurrentKeyID,
+	}
+	for id, hex_key := range c.Keys {
+		kr.Keys[id] = hex_key
+	}
+	for _, id := range strings.Split(c.RetiredKeyIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			kr.Retired = append(kr.Retired, id)
+		}
+	}
+	return kr
+}
+
+// Settings only read at startup. A change is reported but not applied.
+// clog settings are plain variables read by every goroutine without lock.
+var restartSettings = []string{
+	"Name", "LogLevel", "StartLogging", "HTTPaddr", "TCPaddr",
+	"ReadBufferSize", "WriteBufferSize", "HandshakeTimeout", "CertFile", "KeyFile", "StatusUser", "StatusPassword",
+	"ConnectTimeOut", "WriteTimeOut", "ReadTimeOut", "PingPeriod", "MaxLineLength",
+	"ScalingCheckServerPeriod", "MeshCertFile", "MeshKeyFile", "MeshCAFile",
+	"HASH_SIZE", "AcceptLegacyTokens", "TokenTTL", "Commands",
+	"Backend", "FilePath", "KafkaBrokers", "KafkaTopic", "KafkaTopicPerApp", "KafkaKeyStrategy",
+	"KafkaAcks", "KafkaCompression", "KafkaFlushMessages", "KafkaFlushFrequency",
+	"HistorySize", "IncommingOverflow", "UsersOverflow", "ServersOverflow", "MonitorsOverflow",
+}
+
+// Settings applied at runtime by reloadConfig.
+var liveSettings = []string{
+	"ShutdownTimeOut",
+	"MaxUsersConns", "MaxMonitorsConns", "MaxServersConns", "MaxIncommingConns",
+	"MaxUsersConnsPerApp", "Apps", "NBAcceptBySecond", "Servers",
+	"HEX_KEY", "CurrentKeyID", "RetiredKeyIDs", "Keys",
+}
+
+// ReloadReport lists the settings changed by a reload.
+type ReloadReport struct {
+	Applied []string
+	Restart []string
+}
+
+func changedSettings(old *AppConfig, fresh *AppConfig, names []string) []string {
+	var list []string
+	o := reflect.ValueOf(old).Elem()
+	f := reflect.ValueOf(fresh).Elem()
+	for _, name := range names {
+		if !reflect.DeepEqual(o.FieldByName(name).Interface(), f.FieldByName(name).Interface()) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// loadConfig reads the ini file again over a copy of the running config.
+// The map sections are emptied first so that removed entries disappear.
+func loadConfig() *AppConfig {
+	fresh := *currentConf()
+	fresh.AppLimits = AppLimits{}
+	fresh.AppPermissions = AppPermissions{}
+	fresh.KnownBrothers = KnownBrothers{}
+	fresh.Keyring = Keyring{}
+	fresh.CurrentKeyID = "0"
+	fresh.RetiredKeyIDs = ""
+	config.Load("server.ini", &fresh)
+	fitLimits(&fresh, maxOpenFiles())
+	return &fresh
+}
+
+// Serializes the reloads, from SIGHUP and [RLOD].
+var reloadMutex sync.Mutex
+
+// reloadConfig applies server.ini to the running server without dropping
+// the established connections. Nothing is applied if the new keyring is
+// not valid.
+func reloadConfig() (*ReloadReport, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	return applyConfig(loadConfig())
+}
+
+// applyConfig replaces the running config by fresh, keeping the running
+// value of the settings needing a restart.
+func applyConfig(fresh *AppConfig) (*ReloadReport, error) {
+	old := currentConf()
+
+	kr := newKeyring(fresh)
+	if err := Cryptor.SetKeyring(kr); err != nil {
+		clog.Error("server", "reloadConfig", "Config not reloaded, bad keyring: %s", err)
+		return nil, err
+	}
+
+	report := &ReloadReport{
+		Applied: changedSettings(old, fresh, liveSettings),
+		Restart: changedSettings(old, fresh, restartSettings),
+	}
+	o := reflect.ValueOf(old).Elem()
+	f := reflect.ValueOf(fresh).Elem()
+	for _, name := range report.Restart {
+		f.FieldByName(name).Set(o.FieldByName(name))
+	}
+
+	HTTPManager.SetAcceptRate(fresh.NBAcceptBySecond)
+	ScaleList.SetMaxServersConns(fresh.MaxServersConns)
+	MonParams.SetLimits(fresh.MaxUsersConns, fresh.MaxMonitorsConns, fresh.MaxServersConns, fresh.MaxIncommingConns)
+
+	for name, addr := range fresh.KnownBrothers.Servers {
+		ScaleList.AddNewPotentialServer(name, addr)
+	}
+	for name, addr := range old.KnownBrothers.Servers {
+		if fresh.KnownBrothers.Servers[name] != addr {
+			ScaleList.ForgetServer(addr)
+		}
+	}
+
+	confMutex.Lock()
+	conf = fresh
+	confMutex.Unlock()
+
+	clog.Info("server", "reloadConfig", "Config reloaded, keyring has %d keys, current is %s, %d retired", len(kr.Keys), kr.Current, len(kr.Retired))
+	if len(report.Applied) > 0 {
+		clog.Info("server", "reloadConfig", "Applied: %s", strings.Join(report.Applied, ", "))
+	}
+	if len(report.Restart) > 0 {
+		clog.Warn("server", "reloadConfig", "Changed but needing a restart: %s", strings.Join(report.Restart, ", "))
+	}
+	return report, nil
+}
+
+// reloadCommand answers [RLOD] with the JSON ReloadReport.
+func reloadCommand(c *hub.Client, action_group []byte) ([]byte, error) {
+	report, err := reloadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(report)
+}
+
+func handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	for s := range sig {
+		switch s {
+		case syscall.SIGHUP:
+			reloadConfig()
+		default:
+			signal.Stop(sig)
+			shutdown()
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Djoulzy/Tools/clog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangedSettings(t *testing.T) {
+	old := *conf
+	fresh := old
+	fresh.Name = "Other"
+	fresh.LogLevel = old.LogLevel + 1
+	fresh.Apps = map[string]string{"xcode": "3"}
+
+	assert.Equal(t, []string{"Apps"}, changedSettings(&old, &fresh, liveSettings))
+	assert.Equal(t, []string{"Name", "LogLevel"}, changedSettings(&old, &fresh, restartSettings))
+	assert.Nil(t, changedSettings(&old, &old, liveSettings), "Same config should have no change")
+}
+
+func TestApplyConfig(t *testing.T) {
+	original := currentConf()
+	level := clog.LogLevel
+	defer applyConfig(original)
+
+	fresh := *original
+	fresh.Name = "Renamed"
+	fresh.LogLevel = level + 1
+	fresh.HistorySize = original.HistorySize + 10
+	fresh.MaxUsersConnsPerApp = 7
+	report, err := applyConfig(&fresh)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"MaxUsersConnsPerApp"}, report.Applied)
+	assert.Equal(t, []string{"Name", "LogLevel", "HistorySize"}, report.Restart)
+	assert.Equal(t, level, clog.LogLevel, "Log level should only change on restart")
+
+	running := currentConf()
+	assert.Equal(t, 7, running.MaxUsersConnsPerApp, "Live setting should be applied")
+	assert.Equal(t, original.Name, running.Name, "Restart-only setting should keep its running value")
+	assert.Equal(t, original.HistorySize, running.HistorySize, "Restart-only setting should keep its running value")
+
+	bad := *original
+	bad.CurrentKeyID = "missing"
+	_, err = applyConfig(&bad)
+	assert.NotNil(t, err, "Bad keyring should be refused")
+	assert.Equal(t, running, currentConf(), "Nothing should be applied with a bad keyring")
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/Djoulzy/Polycom/hub"
 	"github.com/Djoulzy/Polycom/nettools/httpserver"
 	"github.com/Djoulzy/Polycom/nettools/scaling"
 	"github.com/Djoulzy/Polycom/nettools/tcpserver"
+	"github.com/Djoulzy/Polycom/nettools/tlsconf"
+	"github.com/Djoulzy/Polycom/protocol"
 	"github.com/Djoulzy/Polycom/storage"
 	"github.com/Djoulzy/Polycom/urlcrypt"
 
@@ -18,11 +21,15 @@ import (
 )
 
 var Cryptor *urlcrypt.Cypher
+var Nonces *urlcrypt.NonceCache
+var Perms *Permissions
+var Commands *protocol.Router
 
-var HTTPManager httpserver.Manager
-var TCPManager tcpserver.Manager
+var HTTPManager *httpserver.Manager
+var TCPManager *tcpserver.Manager
 var ScaleList *scaling.ServersList
-var Storage *storage.Driver
+var MonParams *monitoring.Params
+var Store storage.Backend
 
 var zeHub *hub.Hub
 
@@ -45,6 +52,18 @@ func maxOpenFiles() int {
 	return int(rLimit.Cur)
 }
 
+// fitLimits lowers the connection limits of c when they exceed the open files limit.
+func fitLimits(c *AppConfig, maxFiles int) {
+	totalConn := c.MaxUsersConns + c.MaxMonitorsConns + c.MaxServersConns + c.MaxIncommingConns
+	if totalConn > maxFiles {
+		c.MaxUsersConns = maxFiles - 120
+		c.MaxMonitorsConns = 3
+		c.MaxServersConns = 10
+		c.MaxIncommingConns = 100
+		clog.Warn("server", "fitLimits", "Setting MaxUser to %d.", c.MaxUsersConns)
+	}
+}
+
 func main() {
 	config.Load("server.ini", conf)
 
@@ -57,24 +76,61 @@ func main() {
 	clog.Output("Setting maxOpenFiles to %d.", maxFiles)
 	////////////////
 
-	totalConn := conf.MaxUsersConns + conf.MaxMonitorsConns + conf.MaxServersConns + conf.MaxIncommingConns
-	if totalConn > maxFiles {
-		conf.MaxUsersConns = maxFiles - 120
-		conf.MaxMonitorsConns = 3
-		conf.MaxServersConns = 10
-		conf.MaxIncommingConns = 100
-		clog.Warn("server", "main", "Setting MaxUser to %d.", conf.MaxUsersConns)
-	}
+	fitLimits(conf, maxFiles)
 
 	Cryptor = &urlcrypt.Cypher{
-		HASH_SIZE: conf.HASH_SIZE,
-		HEX_KEY:   []byte(conf.HEX_KEY),
-		HEX_IV:    []byte(conf.HEX_IV),
+		HASH_SIZE:    conf.HASH_SIZE,
+		HEX_KEY:      []byte(conf.HEX_KEY),
+		AcceptLegacy: conf.AcceptLegacyTokens,
+	}
+	if err := Cryptor.SetKeyring(newKeyring(conf)); err != nil {
+		clog.Error("server", "main", "Bad keyring: %s", err)
+		return
+	}
+	mesh := &tlsconf.Params{
+		CertFile: conf.MeshCertFile,
+		KeyFile:  conf.MeshKeyFile,
+		CAFile:   conf.MeshCAFile,
 	}
+	if err := mesh.CheckMutual(); err != nil {
+		clog.Error("server", "main", "Mesh TLS needs MeshCAFile: %s", err)
+		return
+	}
+	// A token is accepted TokenTTL before and after its issue time
+	Nonces = urlcrypt.NewNonceCache(2 * time.Duration(conf.TokenTTL) * time.Second)
+
+	Perms = NewPermissions(conf.Commands)
+	Commands = protocol.NewRouter()
+	Commands.Authorize = Perms.Allowed
+	registerCommands(Commands)
 
 	zeHub = hub.NewHub()
+	zeHub.HistorySize = conf.HistorySize
+	for ctype, name := range [4]string{conf.IncommingOverflow, conf.UsersOverflow, conf.ServersOverflow, conf.MonitorsOverflow} {
+		policy, err := hub.ParseOverflow(name)
+		if err != nil {
+			clog.Warn("server", "main", "Bad overflow policy '%s' for %s, using %s", name, hub.CTYpeName[ctype], hub.OverflowName[policy])
+		}
+		zeHub.Overflow[ctype] = policy
+	}
 
-	Storage = storage.Init()
+	var err error
+	Store, err = storage.Init(&storage.Params{
+		Backend:             conf.Backend,
+		FilePath:            conf.FilePath,
+		KafkaBrokers:        conf.KafkaBrokers,
+		KafkaTopic:          conf.KafkaTopic,
+		KafkaTopicPerApp:    conf.KafkaTopicPerApp,
+		KafkaKeyStrategy:    conf.KafkaKeyStrategy,
+		KafkaAcks:           conf.KafkaAcks,
+		KafkaCompression:    conf.KafkaCompression,
+		KafkaFlushMessages:  conf.KafkaFlushMessages,
+		KafkaFlushFrequency: conf.KafkaFlushFrequency,
+	})
+	if err != nil {
+		clog.Error("server", "main", "Cannot start %s storage (%s), records will only be kept in memory.", conf.Backend, err)
+		Store = storage.NewMemoryDriver()
+	}
 
 	mon_params := &monitoring.Params{
 		ServerID:          conf.Name,
@@ -84,7 +140,10 @@ func main() {
 		MaxMonitorsConns:  conf.MaxMonitorsConns,
 		MaxServersConns:   conf.MaxServersConns,
 		MaxIncommingConns: conf.MaxIncommingConns,
+		Storage:           Store,
+		DeniedCommands:    Perms.Denied,
 	}
+	MonParams = mon_params
 	go monitoring.Start(zeHub, mon_params)
 
 	tcp_params := &tcpserver.Manager{
@@ -93,13 +152,18 @@ func main() {
 		Hub:                      zeHub,
 		ConnectTimeOut:           conf.ConnectTimeOut,
 		WriteTimeOut:             conf.WriteTimeOut,
+		ReadTimeOut:              conf.ReadTimeOut,
+		PingPeriod:               conf.PingPeriod,
+		MaxLineLength:            conf.MaxLineLength,
 		ScalingCheckServerPeriod: conf.ScalingCheckServerPeriod,
 		MaxServersConns:          conf.MaxServersConns,
 		CallToAction:             CallToAction,
 		Cryptor:                  Cryptor,
+		TLS:                      mesh,
 	}
 
 	ScaleList = scaling.Init(tcp_params, &conf.KnownBrothers.Servers)
+	zeHub.OnLeave = ScaleList.CloseSession
 	go ScaleList.Start()
 	// go scaling.Start(ScalingServers)
 
@@ -111,14 +175,23 @@ func main() {
 		WriteBufferSize:  conf.WriteBufferSize,
 		HandshakeTimeout: conf.HandshakeTimeout,
 		NBAcceptBySecond: conf.NBAcceptBySecond,
+		StatusUser:       conf.StatusUser,
+		StatusPassword:   conf.StatusPassword,
 		CallToAction:     CallToAction,
 		Cryptor:          Cryptor,
+		TLS: &tlsconf.Params{
+			CertFile: conf.CertFile,
+			KeyFile:  conf.KeyFile,
+		},
 	}
+	HTTPManager = http_params
 	clog.Output("HTTP Server starting listening on %s", conf.HTTPaddr)
 	go HTTPManager.Start(http_params)
 
+	TCPManager = tcp_params
 	clog.Output("TCP Server starting listening on %s", conf.TCPaddr)
 	go TCPManager.Start(tcp_params)
 
+	go handleSignals()
 	zeHub.Run()
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Djoulzy/Polycom/hub"
+
+	"github.com/Djoulzy/Tools/clog"
+)
+
+// ShutdownReason is sent in the close frame of the users which could not be
+// redirected to a brother.
+const ShutdownReason = "Server shutting down"
+
+// drainUsers redirects the users to the healthy brothers, in turn, then
+// disconnects them along with the connections not yet identified.
+func drainUsers() {
+	brothers := ScaleList.HealthyBrothers()
+	redirected := 0
+	for _, ctype := range []int{hub.ClientUndefined, hub.ClientUser} {
+		for _, c := range zeHub.Clients(ctype) {
+			if len(brothers) > 0 && ctype == hub.ClientUser {
+				select {
+				case c.Send <- []byte("[RDCT]" + brothers[redirected%len(brothers)]):
+					redirected++
+				default:
+					clog.Warn("server", "drainUsers", "Cannot redirect %s, send buffer full", c.Name)
+				}
+			}
+			c.Reason = ShutdownReason
+			zeHub.Unregister <- c
+		}
+	}
+	if redirected > 0 {
+		clog.Info("server", "drainUsers", "%d users redirected to %s", redirected, strings.Join(brothers, ", "))
+	}
+}
+
+// shutdown stops the listeners, drains the users, flushes the storage and
+// stops the hub. The process exits anyway after ShutdownTimeOut seconds.
+func shutdown() {
+	timeout := time.Duration(currentConf().ShutdownTimeOut) * time.Second
+	clog.Info("server", "shutdown", "Shutting down within %s", timeout)
+	time.AfterFunc(timeout, func() {
+		clog.Error("server", "shutdown", "Shutdown deadline exceeded, exiting now")
+		os.Exit(1)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := HTTPManager.Shutdown(ctx); err != nil {
+		clog.Warn("server", "shutdown", "HTTP listener: %s", err)
+	}
+	if err := TCPManager.Stop(); err != nil {
+		clog.Warn("server", "shutdown", "TCP listener: %s", err)
+	}
+
+	drainUsers()
+
+	if err := Store.Flush(ctx); err != nil {
+		clog.Error("server", "shutdown", "Cannot flush storage: %s", err)
+	}
+	if err := Store.Close(); err != nil {
+		clog.Error("server", "shutdown", "Cannot close storage: %s", err)
+	}
+
+	zeHub.Done <- true
+}
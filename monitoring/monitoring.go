@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"math"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/storage"
 	"github.com/Djoulzy/Tools/clog"
 
 	"github.com/shirou/gopsutil/cpu"
@@ -22,6 +24,7 @@ type ClientList map[string]*hub.Client
 type Brother struct {
 	Tcpaddr  string
 	Httpaddr string
+	State    string `json:",omitempty"`
 }
 
 type ServerMetrics struct {
@@ -47,6 +50,13 @@ type ServerMetrics struct {
 	NBS      int
 	MXS      int
 	BRTHLST  map[string]Brother
+	TOPICS   []string
+	STORPROD int64
+	STORFAIL int64
+	DENIED   int64
+	DROPPED  int64
+	SLOW     map[string]int64 `json:",omitempty"`
+	APPS     map[string]int   `json:",omitempty"`
 }
 
 type BrotherList struct {
@@ -67,15 +77,32 @@ type Params struct {
 	MaxMonitorsConns  int
 	MaxServersConns   int
 	MaxIncommingConns int
+	Storage           storage.Backend
+	DeniedCommands    func() int64
+
+	limitsMutex sync.RWMutex
+}
+
+// SetLimits changes the connection limits reported in the metrics.
+func (p *Params) SetLimits(users, monitors, servers, incomming int) {
+	p.limitsMutex.Lock()
+	p.MaxUsersConns = users
+	p.MaxMonitorsConns = monitors
+	p.MaxServersConns = servers
+	p.MaxIncommingConns = incomming
+	p.limitsMutex.Unlock()
 }
 
 var StartTime time.Time
 var UpTime time.Duration
 var MachineLoad *load.AvgStat
+var loadMutex sync.RWMutex
 var nbcpu int
 var cr ClientsRegister
 var AddBrother = make(chan map[string]Brother)
 var brotherlist = make(map[string]Brother)
+var brotherStates = make(map[string]Brother)
+var brotherStatesMutex sync.Mutex
 
 func getMemUsage() string {
 	v, _ := mem.VirtualMemory()
@@ -93,6 +120,62 @@ func addToBrothersList(srv map[string]Brother) {
 	}
 }
 
+// slowClients returns the drop counters of the clients having lost messages.
+func slowClients(snap *hub.Snapshot) map[string]int64 {
+	var list map[string]int64
+	for _, client := range snap.Clients {
+		if client.Drops > 0 {
+			if list == nil {
+				list = make(map[string]int64)
+			}
+			list[client.Name] = client.Drops
+		}
+	}
+	return list
+}
+
+// Load returns the last machine load average read.
+func Load() string {
+	loadMutex.RLock()
+	defer loadMutex.RUnlock()
+	return MachineLoad.String()
+}
+
+// SetBrotherState records the state of the mesh link to a brother, as seen
+// by the scaling supervisor. It never blocks.
+func SetBrotherState(name string, tcpaddr string, state string) {
+	brotherStatesMutex.Lock()
+	brotherStates[name] = Brother{Tcpaddr: tcpaddr, State: state}
+	brotherStatesMutex.Unlock()
+}
+
+// ForgetBrotherState drops the link state of a brother removed from the mesh.
+func ForgetBrotherState(name string) {
+	brotherStatesMutex.Lock()
+	delete(brotherStates, name)
+	brotherStatesMutex.Unlock()
+}
+
+// brothersWithStates merges the brothers learned from metrics with the link states.
+func brothersWithStates() map[string]Brother {
+	list := make(map[string]Brother, len(brotherlist))
+	for name, infos := range brotherlist {
+		list[name] = infos
+	}
+
+	brotherStatesMutex.Lock()
+	defer brotherStatesMutex.Unlock()
+	for name, link := range brotherStates {
+		infos, ok := list[name]
+		if !ok {
+			infos.Tcpaddr = link.Tcpaddr
+		}
+		infos.State = link.State
+		list[name] = infos
+	}
+	return list
+}
+
 func LoadAverage(h *hub.Hub, p *Params) {
 	ticker := time.NewTicker(statsTimer)
 	MachineLoad = &load.AvgStat{0, 0, 0}
@@ -105,12 +188,16 @@ func LoadAverage(h *hub.Hub, p *Params) {
 			addToBrothersList(newSrv)
 		case <-ticker.C:
 			tmp, _ := load.Avg()
+			loadMutex.Lock()
 			MachineLoad = tmp
+			loadMutex.Unlock()
 			loadIndice := int(math.Ceil((((MachineLoad.Load1*5 + MachineLoad.Load5*3 + MachineLoad.Load15*2) / 10) / float64(nbcpu)) * 100))
 			// mess := NewMessage(nil, machineLoad.String())
 			t := time.Now()
 			UpTime = time.Since(StartTime)
 
+			snap := h.Snapshot()
+			p.limitsMutex.RLock()
 			newStats := ServerMetrics{
 				SID:      p.ServerID,
 				TCPADDR:  p.Tcpaddr,
@@ -124,16 +211,31 @@ func LoadAverage(h *hub.Hub, p *Params) {
 				LAVG:     loadIndice,
 				MEM:      getMemUsage(),
 				SWAP:     getSwapUsage(),
-				NBMESS:   h.SentMessByTicks,
-				NBI:      len(h.Incomming),
+				NBMESS:   snap.Sent,
+				NBI:      snap.Counts[hub.ClientUndefined],
 				MXI:      p.MaxIncommingConns,
-				NBU:      len(h.Users),
+				NBU:      snap.Counts[hub.ClientUser],
 				MXU:      p.MaxUsersConns,
-				NBM:      len(h.Monitors),
+				NBM:      snap.Counts[hub.ClientMonitor],
 				MXM:      p.MaxMonitorsConns,
-				NBS:      len(h.Servers),
+				NBS:      snap.Counts[hub.ClientServer],
 				MXS:      p.MaxServersConns,
-				BRTHLST:  brotherlist,
+				BRTHLST:  brothersWithStates(),
+				TOPICS:   snap.Topics,
+				DROPPED:  snap.Dropped,
+				SLOW:     slowClients(snap),
+				APPS:     snap.Apps,
+			}
+			p.limitsMutex.RUnlock()
+
+			if p.Storage != nil {
+				stats := p.Storage.Stats()
+				newStats.STORPROD = stats.Produced
+				newStats.STORFAIL = stats.Failed
+			}
+
+			if p.DeniedCommands != nil {
+				newStats.DENIED = p.DeniedCommands()
 			}
 
 			newBrthList := BrotherList{
@@ -145,8 +247,8 @@ func LoadAverage(h *hub.Hub, p *Params) {
 			if err != nil {
 				clog.Error("Monitoring", "LoadAverage", "MON: Cannot send server metrics to listeners ...")
 			} else {
-				if len(h.Monitors)+len(h.Servers) > 0 {
-					h.SentMessByTicks = 0
+				if snap.Counts[hub.ClientMonitor]+snap.Counts[hub.ClientServer] > 0 {
+					h.ResetSentMessages()
 					mess := hub.NewMessage(hub.ClientMonitor, nil, json)
 					h.Broadcast <- mess
 					mess = hub.NewMessage(hub.ClientServer, nil, append([]byte("[MNIT]"), json...))
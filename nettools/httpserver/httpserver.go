@@ -2,16 +2,21 @@ package httpserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	"github.com/Djoulzy/Polycom/hub"
 	"github.com/Djoulzy/Polycom/monitoring"
+	"github.com/Djoulzy/Polycom/nettools/tlsconf"
+	"github.com/Djoulzy/Polycom/protocol"
 	"github.com/Djoulzy/Polycom/urlcrypt"
 	"github.com/Djoulzy/Tools/clog"
 )
@@ -38,23 +43,54 @@ type Manager struct {
 	WriteBufferSize  int
 	NBAcceptBySecond int
 	HandshakeTimeout int
+	StatusUser       string // Basic auth of the pages handing out tokens,
+	StatusPassword   string // which are not served without a password
 	CallToAction     func(*hub.Client, []byte)
 	Cryptor          *urlcrypt.Cypher
+	TLS              *tlsconf.Params // Serves wss:// when set
+
+	server      *http.Server
+	throttle    *time.Ticker
+	serverMutex sync.Mutex
+	closing     bool
+}
+
+// authorized checks the basic auth of the pages handing out tokens.
+func (m *Manager) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if m.StatusPassword == "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(m.StatusUser)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(m.StatusPassword)) != 1 {
+		clog.Warn("HTTPServer", "authorized", "Refused %s to %s", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="Polycom"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
 }
 
 func (m *Manager) statusPage(w http.ResponseWriter, r *http.Request) {
-	handShake, _ := m.Cryptor.Encrypt_b64("MNTR|Monitoring|MNTR")
+	if !m.authorized(w, r) {
+		return
+	}
+	handShake, _ := m.Cryptor.NewHandshake("MNTR", "Monitoring", "MNTR", m.Httpaddr)
+	snap := m.Hub.Snapshot()
 	var data = struct {
-		Host   string
-		Nb     int
-		Users  map[string]*hub.Client
-		Stats  string
-		HShake string
+		Host     string
+		Nb       int
+		Snapshot *hub.Snapshot
+		Types    [4]string
+		Stats    string
+		HShake   string
 	}{
 		m.Httpaddr,
-		len(m.Hub.Users),
-		m.Hub.Users,
-		monitoring.MachineLoad.String(),
+		snap.Counts[hub.ClientUser],
+		snap,
+		hub.CTYpeName,
+		monitoring.Load(),
 		string(handShake),
 	}
 
@@ -67,7 +103,10 @@ func (m *Manager) statusPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Manager) testPage(w http.ResponseWriter, r *http.Request) {
-	handShake, _ := m.Cryptor.Encrypt_b64("LOAD_1|TestPage|USER")
+	if !m.authorized(w, r) {
+		return
+	}
+	handShake, _ := m.Cryptor.NewHandshake("LOAD_1", "TestPage", "USER", m.Httpaddr)
 
 	var data = struct {
 		Host   string
@@ -87,6 +126,9 @@ func (m *Manager) testPage(w http.ResponseWriter, r *http.Request) {
 
 func (m *Manager) Connect() *websocket.Conn {
 	u := url.URL{Scheme: "ws", Host: m.Httpaddr, Path: "/ws"}
+	if m.TLS.Enabled() {
+		u.Scheme = "wss"
+	}
 	clog.Info("HTTPServer", "Connect", "Connecting to %s", u.String())
 
 	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
@@ -111,14 +153,16 @@ func (m *Manager) Reader(conn *websocket.Conn, cli *hub.Client) {
 		return nil
 	})
 	for {
-		_, message, err := conn.ReadMessage()
+		mt, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
 				clog.Error("HTTPServer", "Reader", "%v", err)
 			}
 			return
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, Newline, Space, -1))
+		if mt == websocket.TextMessage {
+			message = bytes.TrimSpace(bytes.Replace(message, Newline, Space, -1))
+		}
 		go m.CallToAction(cli, message)
 	}
 }
@@ -128,6 +172,14 @@ func (m *Manager) _write(ws *websocket.Conn, mt int, message []byte) error {
 	return ws.WriteMessage(mt, message)
 }
 
+// _send writes a message queued in the text form with the framing of the client.
+func (m *Manager) _send(ws *websocket.Conn, cli *hub.Client, message []byte) error {
+	if cli.Framing == protocol.FramingBinary {
+		return m._write(ws, websocket.BinaryMessage, protocol.EncodeText(cli.Framing, message))
+	}
+	return m._write(ws, websocket.TextMessage, protocol.EncodeText(cli.Framing, message))
+}
+
 func (m *Manager) Writer(conn *websocket.Conn, cli *hub.Client) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -138,8 +190,13 @@ func (m *Manager) Writer(conn *websocket.Conn, cli *hub.Client) {
 	for {
 		select {
 		case message, ok := <-cli.Send:
+			if !ok && <-cli.Quit {
+				// Unregistered by the hub, Quit was missed for the closed Send
+				m.quit(conn, cli)
+				return
+			}
 			if !ok {
-				clog.Warn("HTTPServer", "Writer", "Error: %s", ok)
+				clog.Warn("HTTPServer", "Writer", "Send channel of %s closed", cli.Name)
 				cm := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Something went wrong !")
 				if err := m._write(conn, websocket.CloseMessage, cm); err != nil {
 					clog.Error("HTTPServer", "Writer", "Connection lost ! Cannot send CloseMessage to %s", cli.Name)
@@ -147,7 +204,7 @@ func (m *Manager) Writer(conn *websocket.Conn, cli *hub.Client) {
 				return
 			}
 			// clog.Debug("HTTPServer", "Writer", "Sending: %s", message)
-			if err := m._write(conn, websocket.TextMessage, message); err != nil {
+			if err := m._send(conn, cli, message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -156,10 +213,38 @@ func (m *Manager) Writer(conn *websocket.Conn, cli *hub.Client) {
 				return
 			}
 		case <-cli.Quit:
-			cm := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "An other device is using your account !")
-			if err := m._write(conn, websocket.CloseMessage, cm); err != nil {
-				clog.Error("HTTPServer", "Writer", "Cannot write CloseMessage to %s", cli.Name)
+			m.quit(conn, cli)
+			return
+		}
+	}
+}
+
+// quit writes the queued messages then the close frame with the reason of
+// the disconnection.
+func (m *Manager) quit(conn *websocket.Conn, cli *hub.Client) {
+	m.flush(conn, cli)
+	reason := cli.Reason
+	if reason == "" {
+		reason = "An other device is using your account !"
+	}
+	cm := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+	if err := m._write(conn, websocket.CloseMessage, cm); err != nil {
+		clog.Error("HTTPServer", "Writer", "Cannot write CloseMessage to %s", cli.Name)
+	}
+}
+
+// flush writes the messages still queued for a client which is being disconnected.
+func (m *Manager) flush(conn *websocket.Conn, cli *hub.Client) {
+	for {
+		select {
+		case message, ok := <-cli.Send:
+			if !ok {
+				return
 			}
+			if err := m._send(conn, cli, message); err != nil {
+				return
+			}
+		default:
 			return
 		}
 	}
@@ -187,7 +272,7 @@ func (m *Manager) wsConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := &hub.Client{Quit: make(chan bool),
+	client := &hub.Client{Quit: make(chan bool, 1),
 		CType: hub.ClientUndefined, Send: make(chan []byte, 256), CallToAction: m.CallToAction, Addr: httpconn.RemoteAddr().String(),
 		Name: name, Content_id: 0, Front_id: "", App_id: "", Country: "", User_agent: ua}
 
@@ -196,8 +281,18 @@ func (m *Manager) wsConnect(w http.ResponseWriter, r *http.Request) {
 	go m.Reader(httpconn, client)
 }
 
-func throttleClients(h http.Handler, n int) http.Handler {
-	ticker := time.NewTicker(time.Second / time.Duration(n))
+func acceptPeriod(n int) time.Duration {
+	if n <= 0 {
+		n = 1
+	}
+	return time.Second / time.Duration(n)
+}
+
+func (m *Manager) throttleClients(h http.Handler, n int) http.Handler {
+	m.serverMutex.Lock()
+	m.throttle = time.NewTicker(acceptPeriod(n))
+	ticker := m.throttle
+	m.serverMutex.Unlock()
 	// sema := make(chan struct{}, n)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -208,6 +303,16 @@ func throttleClients(h http.Handler, n int) http.Handler {
 	})
 }
 
+// SetAcceptRate changes the number of websockets accepted by second, without
+// dropping the established ones.
+func (m *Manager) SetAcceptRate(n int) {
+	m.serverMutex.Lock()
+	defer m.serverMutex.Unlock()
+	if m.throttle != nil {
+		m.throttle.Reset(acceptPeriod(n))
+	}
+}
+
 func (m *Manager) Start(conf *Manager) {
 	m = conf
 	Upgrader = &websocket.Upgrader{
@@ -229,11 +334,39 @@ func (m *Manager) Start(conf *Manager) {
 	http.HandleFunc("/status", m.statusPage)
 
 	handler := http.HandlerFunc(m.wsConnect)
-	http.Handle("/ws", throttleClients(handler, m.NBAcceptBySecond))
+	http.Handle("/ws", m.throttleClients(handler, m.NBAcceptBySecond))
 	// http.HandleFunc("/ws", m.wsConnect)
 
-	err := http.ListenAndServe(m.Httpaddr, nil)
-	if err != nil {
+	m.serverMutex.Lock()
+	if m.closing {
+		m.serverMutex.Unlock()
+		return
+	}
+	m.server = &http.Server{Addr: m.Httpaddr}
+	server := m.server
+	m.serverMutex.Unlock()
+
+	var err error
+	if m.TLS.Enabled() {
+		err = server.ListenAndServeTLS(m.TLS.CertFile, m.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("HTTPServer: ", err)
 	}
 }
+
+// Shutdown stops accepting new connections. The websockets already
+// established are not closed, they belong to the hub.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.serverMutex.Lock()
+	m.closing = true
+	server := m.server
+	m.serverMutex.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
@@ -2,7 +2,9 @@ package scaling
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Djoulzy/Polycom/hub"
@@ -13,6 +15,17 @@ import (
 
 var serverCheckPeriod = 10 * time.Second
 
+// maxBackoff caps the delay between two connection attempts to a brother.
+var maxBackoff = 5 * time.Minute
+
+// Mesh link states, as shown on the status page.
+const (
+	StateDisconnected = "DISCONNECTED"
+	StateConnecting   = "CONNECTING"
+	StateConnected    = "CONNECTED"
+	StateBackoff      = "BACKOFF"
+)
+
 type NearbyServer struct {
 	hubclient   *hub.Client
 	distantName string
@@ -21,21 +34,44 @@ type NearbyServer struct {
 	freeslots   int
 	httpaddr    string
 	tcpaddr     string
+	topics      map[string]bool
+
+	state     string
+	attempts  int
+	nextTry   time.Time
+	lastError error
 }
 
 type ServersList struct {
 	nodes           map[string]*NearbyServer
+	nodesMutex      sync.RWMutex
+	linksMutex      sync.Mutex
 	tcpmanager      *tcpserver.Manager
 	localName       string
 	localAddr       string
 	MaxServersConns int
 	Hub             *hub.Hub
+	checkPeriod     time.Duration
+
+	// Session directory, indexed by qualified user name, and the local
+	// sessions opened and closed since the last [SDIR].
+	sessions      map[string]*Session
+	opened        map[string]uint64
+	closed        map[string]uint64
+	sessionsMutex sync.Mutex
 }
 
 func (slist *ServersList) UpdateMetrics(addr string, message []byte) {
+	slist.nodesMutex.RLock()
 	serv := slist.nodes[addr]
+	slist.nodesMutex.RUnlock()
+	if serv == nil {
+		clog.Warn("Scaling", "updateMetrics", "Metrics received from unknown server %s", addr)
+		return
+	}
+
 	h := slist.Hub
-	if len(h.Monitors)+len(h.Servers) > 0 {
+	if h.Count(hub.ClientMonitor)+h.Count(hub.ClientServer) > 0 {
 		clog.Debug("Scaling", "updateMetrics", "Update Metrics for %s", serv.tcpaddr)
 
 		var metrics monitoring.ServerMetrics
@@ -45,9 +81,17 @@ func (slist *ServersList) UpdateMetrics(addr string, message []byte) {
 			clog.Error("Scaling", "updateMetrics", "Cannot reading distant server metrics")
 			return
 		}
+		slist.nodesMutex.Lock()
 		serv.cpuload = metrics.LAVG
 		serv.freeslots = (metrics.MXU - metrics.NBU)
 		serv.httpaddr = metrics.HTTPADDR
+		if metrics.TOPICS != nil {
+			serv.topics = topicSet(metrics.TOPICS)
+			for app_id := range metrics.APPS {
+				serv.topics[hub.TenantName(app_id, hub.BroadcastTopic)] = true
+			}
+		}
+		slist.nodesMutex.Unlock()
 
 		for name, infos := range metrics.BRTHLST {
 			slist.AddNewPotentialServer(name, infos.Tcpaddr)
@@ -60,47 +104,275 @@ func (slist *ServersList) UpdateMetrics(addr string, message []byte) {
 		}
 		monitoring.AddBrother <- newSrv
 
-		if len(h.Monitors) > 0 {
+		if h.Count(hub.ClientMonitor) > 0 {
 			mess := hub.NewMessage(hub.ClientMonitor, nil, message)
 			h.Broadcast <- mess
 		}
 	}
 }
 
+func topicSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, topic := range list {
+		set[topic] = true
+	}
+	return set
+}
+
+// UpdateTopics records the interest set advertised by a brother ([TPCS]): its
+// topics and the App_ids of its users, see hub.InterestList.
+func (slist *ServersList) UpdateTopics(addr string, message []byte) {
+	var topics []string
+
+	err := json.Unmarshal(message, &topics)
+	if err != nil {
+		clog.Error("Scaling", "UpdateTopics", "Cannot read distant server topics")
+		return
+	}
+
+	slist.nodesMutex.Lock()
+	defer slist.nodesMutex.Unlock()
+	if serv := slist.nodes[addr]; serv != nil {
+		clog.Debug("Scaling", "UpdateTopics", "Server %s is interested in %d topics", serv.distantName, len(topics))
+		serv.topics = topicSet(topics)
+	}
+}
+
+// brothers returns the links of the connected brothers accepted by keep. The
+// messages are sent once nodesMutex is released, the hub may be busy.
+func (slist *ServersList) brothers(keep func(node *NearbyServer) bool) []*hub.Client {
+	slist.nodesMutex.RLock()
+	links := make([]*hub.Client, 0, len(slist.nodes))
+	for _, node := range slist.nodes {
+		if node.connected && keep(node) {
+			links = append(links, node.hubclient)
+		}
+	}
+	slist.nodesMutex.RUnlock()
+
+	registered := links[:0]
+	for _, link := range links {
+		if slist.Hub.IsRegistered(link) {
+			registered = append(registered, link)
+		}
+	}
+	return registered
+}
+
+// PublishToBrothers forwards a topic message to the connected brothers having
+// at least one subscriber for it.
+func (slist *ServersList) PublishToBrothers(topic string, message []byte) {
+	for _, link := range slist.brothers(func(node *NearbyServer) bool { return node.topics[topic] }) {
+		slist.Hub.Unicast <- hub.NewMessage(hub.ClientServer, link, message)
+	}
+}
+
+// SendToBrothers sends a message to every connected brother and returns how
+// many were reached.
+func (slist *ServersList) SendToBrothers(message []byte) int {
+	links := slist.brothers(func(node *NearbyServer) bool { return true })
+	for _, link := range links {
+		slist.Hub.Unicast <- hub.NewMessage(hub.ClientServer, link, message)
+	}
+	return len(links)
+}
+
+// setState must be called with nodesMutex held.
+func (slist *ServersList) setState(node *NearbyServer, state string) {
+	if node.state != state {
+		clog.Info("Scaling", "setState", "Link to %s (%s): %s -> %s", node.distantName, node.tcpaddr, node.state, state)
+		node.state = state
+	}
+	monitoring.SetBrotherState(node.distantName, node.tcpaddr, state)
+}
+
+// backoff returns the delay before the next connection attempt after
+// attempts consecutive failures.
+func (slist *ServersList) backoff(attempts int) time.Duration {
+	delay := slist.checkPeriod
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// retryLater must be called with nodesMutex held.
+func (slist *ServersList) retryLater(node *NearbyServer, err error) {
+	node.attempts++
+	node.lastError = err
+	node.nextTry = time.Now().Add(slist.backoff(node.attempts))
+	clog.Warn("Scaling", "retryLater", "Server %s (%s) unreachable (attempt %d), next try at %s: %s", node.distantName, node.tcpaddr, node.attempts, node.nextTry.Format("15:04:05"), err)
+	slist.setState(node, StateBackoff)
+}
+
+// dial connects to a brother and serves the link until it closes.
+func (slist *ServersList) dial(addr string) {
+	slist.nodesMutex.RLock()
+	node := slist.nodes[addr]
+	slist.nodesMutex.RUnlock()
+	if node == nil {
+		return
+	}
+
+	conn, err := slist.tcpmanager.Connect(addr)
+	if err != nil {
+		slist.nodesMutex.Lock()
+		slist.retryLater(node, err)
+		slist.nodesMutex.Unlock()
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	slist.tcpmanager.NewOutgoingConn(conn, node.distantName, &wg)
+	slist.linkClosed(node)
+}
+
+// linkClosed updates a node once one of its links has gone away. The hub is
+// queried without nodesMutex, which would otherwise be held while it is busy.
+func (slist *ServersList) linkClosed(node *NearbyServer) {
+	slist.nodesMutex.RLock()
+	link := node.hubclient
+	slist.nodesMutex.RUnlock()
+	registered := link != nil && slist.Hub.IsRegistered(link)
+
+	slist.nodesMutex.Lock()
+	defer slist.nodesMutex.Unlock()
+
+	if node.connected && node.hubclient == link && registered {
+		// The link was a duplicate, the brother is still reachable through the other one.
+		return
+	}
+	if node.state == StateConnecting {
+		slist.retryLater(node, errors.New("link closed before identification"))
+		return
+	}
+	node.connected = false
+	slist.setState(node, StateDisconnected)
+}
+
+// brotherConnected tells if a link to a server named name is already registered in the hub.
+func (slist *ServersList) brotherConnected(name string) bool {
+	return slist.Hub.UserExists(name, hub.ClientServer)
+}
+
+// nodeView is a copy of the fields of a node read by the supervisor.
+type nodeView struct {
+	node      *NearbyServer
+	name      string
+	link      *hub.Client
+	connected bool
+
+	registered bool // link is still in the hub
+	linked     bool // a link to the brother name is in the hub
+}
+
+// checkingNewServers dials the known brothers we are not linked with yet.
+// The nodes are copied under nodesMutex, the hub is queried without it, and
+// the nodes which did not change meanwhile are updated.
 func (slist *ServersList) checkingNewServers() {
-	// var wg sync.WaitGroup
-
-	// spew.Dump(slist)
-	// for addr, node := range slist.nodes {
-	// 	if node.hubclient == nil || node.hubclient.Hub == nil {
-	// 		conn, err := slist.tcpmanager.Connect(addr)
-	// 		if err == nil {
-	// 			clog.Trace("Scaling", "checkingNewServers", "Trying new server -> %s (%s)", node.distantName, addr)
-	// 			wg.Add(1)
-	// 			go slist.tcpmanager.NewOutgoingConn(conn, node.distantName, &wg)
-	// 			wg.Wait()
-	// 			node.connected = true
-	// 		}
-	// 	}
-	// }
+	slist.nodesMutex.RLock()
+	views := make(map[string]*nodeView, len(slist.nodes))
+	for addr, node := range slist.nodes {
+		views[addr] = &nodeView{node: node, name: node.distantName, link: node.hubclient, connected: node.connected}
+	}
+	slist.nodesMutex.RUnlock()
+
+	for _, view := range views {
+		view.registered = view.connected && view.link != nil && slist.Hub.IsRegistered(view.link)
+		view.linked = slist.brotherConnected(view.name)
+	}
+	servers := slist.Hub.Count(hub.ClientServer)
+
+	slist.nodesMutex.Lock()
+	defer slist.nodesMutex.Unlock()
+
+	now := time.Now()
+	for addr, view := range views {
+		node := view.node
+		if slist.nodes[addr] != node || node.hubclient != view.link || node.connected != view.connected {
+			continue
+		}
+		if node.connected && !view.registered {
+			node.connected = false
+			slist.setState(node, StateDisconnected)
+		}
+		if node.connected || node.state == StateConnecting || now.Before(node.nextTry) {
+			continue
+		}
+		if view.linked {
+			continue
+		}
+		if servers >= slist.MaxServersConns {
+			clog.Debug("Scaling", "checkingNewServers", "Max servers connections reached, not dialing %s", node.distantName)
+			return
+		}
+
+		clog.Trace("Scaling", "checkingNewServers", "Trying new server -> %s (%s)", node.distantName, addr)
+		slist.setState(node, StateConnecting)
+		go slist.dial(addr)
+	}
+}
+
+// AcceptLink tells if a newly identified link to the brother name must be kept.
+// When both servers dialed each other at the same time, the link initiated by
+// the server having the smallest name wins on both ends.
+func (slist *ServersList) AcceptLink(c *hub.Client, name string) bool {
+	existing := slist.Hub.GetClientByName(name, hub.ClientServer)
+	if existing == nil || existing == c || existing.Outbound == c.Outbound {
+		return true
+	}
+	keepOutbound := slist.localName < name
+	if c.Outbound != keepOutbound {
+		clog.Info("Scaling", "AcceptLink", "Dropping duplicate link to %s", name)
+		return false
+	}
+	return true
+}
+
+// IdentifyLink registers c as the link to the brother name, unless AcceptLink
+// drops it. Both are done in one step, so that two links identified at the same
+// time can't both be accepted. A brother which dialed us is answered with our
+// [HELO], made for its addr, before anything else.
+func (slist *ServersList) IdentifyLink(c *hub.Client, name string, addr string) bool {
+	slist.linksMutex.Lock()
+	defer slist.linksMutex.Unlock()
+
+	if !slist.AcceptLink(c, name) {
+		return false
+	}
+	if !c.Outbound {
+		slist.tcpmanager.Hello(c, addr)
+	}
+	slist.Hub.Newrole(&hub.ConnModifier{Client: c, NewName: name, NewType: hub.ClientServer, NewAddr: addr})
+	return true
 }
 
 func (slist *ServersList) AddNewConnectedServer(c *hub.Client) {
 	clog.Info("Scaling", "AddNewConnectedServer", "Commit of server %s to scaling procedure.", c.Name)
-	slist.nodes[c.Addr] = &NearbyServer{
-		// manager: &tcpserver.Manager{
-		// 	ServerName: c.Name,
-		// 	Hub:        c.Hub,
-		// 	Tcpaddr:    c.Addr,
-		// },
-		distantName: c.Name,
-		tcpaddr:     c.Addr,
-		connected:   true,
-		hubclient:   c,
+	defer slist.sendSessions(c)
+	slist.nodesMutex.Lock()
+	defer slist.nodesMutex.Unlock()
+	node := slist.nodes[c.Addr]
+	if node == nil {
+		node = &NearbyServer{}
+		slist.nodes[c.Addr] = node
 	}
+	node.distantName = c.Name
+	node.tcpaddr = c.Addr
+	node.connected = true
+	node.hubclient = c
+	node.attempts = 0
+	node.lastError = nil
+	slist.setState(node, StateConnected)
 }
 
 func (slist *ServersList) AddNewPotentialServer(name string, addr string) {
+	slist.nodesMutex.Lock()
+	defer slist.nodesMutex.Unlock()
 	if slist.nodes[addr] == nil {
 		if addr != slist.localAddr {
 			clog.Info("Scaling", "AddNewPotentialServer", "New server : %s (%s)", name, addr)
@@ -115,10 +387,29 @@ func (slist *ServersList) AddNewPotentialServer(name string, addr string) {
 				tcpaddr:     addr,
 				connected:   false,
 			}
+			slist.setState(slist.nodes[addr], StateDisconnected)
 		}
 	}
 }
 
+// SetMaxServersConns changes the number of brothers the supervisor may dial.
+func (slist *ServersList) SetMaxServersConns(max int) {
+	slist.nodesMutex.Lock()
+	slist.MaxServersConns = max
+	slist.nodesMutex.Unlock()
+}
+
+// ForgetServer drops a brother which is not linked anymore.
+func (slist *ServersList) ForgetServer(addr string) {
+	slist.nodesMutex.Lock()
+	defer slist.nodesMutex.Unlock()
+	if node := slist.nodes[addr]; node != nil && !node.connected {
+		clog.Info("Scaling", "ForgetServer", "Forgetting server %s (%s)", node.distantName, addr)
+		delete(slist.nodes, addr)
+		monitoring.ForgetBrotherState(node.distantName)
+	}
+}
+
 func Init(conf *tcpserver.Manager, list *map[string]string) *ServersList {
 	slist := &ServersList{
 		nodes:           make(map[string]*NearbyServer),
@@ -127,6 +418,13 @@ func Init(conf *tcpserver.Manager, list *map[string]string) *ServersList {
 		localAddr:       conf.Tcpaddr,
 		MaxServersConns: conf.MaxServersConns,
 		Hub:             conf.Hub,
+		checkPeriod:     time.Duration(conf.ScalingCheckServerPeriod) * time.Second,
+		sessions:        make(map[string]*Session),
+		opened:          make(map[string]uint64),
+		closed:          make(map[string]uint64),
+	}
+	if slist.checkPeriod <= 0 {
+		slist.checkPeriod = serverCheckPeriod
 	}
 
 	if list != nil {
@@ -137,37 +435,57 @@ func Init(conf *tcpserver.Manager, list *map[string]string) *ServersList {
 	return slist
 }
 
-func (slist *ServersList) RedirectConnection(client *hub.Client) bool {
+// HealthyBrother returns the HTTP address of a connected brother able to
+// take a user, or an empty string if there is none.
+func (slist *ServersList) HealthyBrother() string {
+	if list := slist.HealthyBrothers(); len(list) > 0 {
+		return list[0]
+	}
+	return ""
+}
+
+// HealthyBrothers returns the HTTP addresses of the connected brothers able
+// to take users.
+func (slist *ServersList) HealthyBrothers() []string {
+	slist.nodesMutex.RLock()
+	defer slist.nodesMutex.RUnlock()
+	var list []string
 	for _, node := range slist.nodes {
 		if node.connected {
-			clog.Trace("Scaling", "RedirectConnection", "Server %s CPU: %d Slots: %d", node.hubclient.Name, node.cpuload, node.freeslots)
-			if node.cpuload < 80 && node.freeslots > 0 {
-				redirect := fmt.Sprintf("[RDCT]%s", node.httpaddr)
-				client.Send <- []byte(redirect)
-				clog.Info("Scaling", "RedirectConnection", "Client redirect -> %s (%s)", node.hubclient.Name, node.httpaddr)
-				return true
+			clog.Trace("Scaling", "HealthyBrothers", "Server %s CPU: %d Slots: %d", node.hubclient.Name, node.cpuload, node.freeslots)
+			if node.cpuload < 80 && node.freeslots > 0 && node.httpaddr != "" {
+				list = append(list, node.httpaddr)
 			} else {
-				clog.Warn("Scaling", "RedirectConnection", "Server %s full ...", node.hubclient.Name)
+				clog.Warn("Scaling", "HealthyBrothers", "Server %s full ...", node.hubclient.Name)
 			}
 		}
 	}
-	return false
+	return list
 }
 
-func (slist *ServersList) DispatchNewConnection(h *hub.Hub, name string) {
-	message := []byte(fmt.Sprintf("[KILL]%s", name))
-	mess := hub.NewMessage(hub.ClientServer, nil, message)
-	h.Broadcast <- mess
+func (slist *ServersList) RedirectConnection(client *hub.Client) bool {
+	httpaddr := slist.HealthyBrother()
+	if httpaddr == "" {
+		return false
+	}
+	redirect := fmt.Sprintf("[RDCT]%s", httpaddr)
+	client.Send <- []byte(redirect)
+	clog.Info("Scaling", "RedirectConnection", "Client redirect -> %s", httpaddr)
+	return true
 }
 
 func (slist *ServersList) Start() {
-	ticker := time.NewTicker(serverCheckPeriod)
+	ticker := time.NewTicker(slist.checkPeriod)
 	defer ticker.Stop()
+	sessionsTicker := time.NewTicker(sessionsPeriod)
+	defer sessionsTicker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			slist.checkingNewServers()
+		case <-sessionsTicker.C:
+			slist.flushSessions()
 		}
 	}
 }
@@ -1,12 +1,17 @@
 package scaling
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Djoulzy/Polycom/hub"
 	"github.com/Djoulzy/Polycom/monitoring"
 	"github.com/Djoulzy/Polycom/nettools/tcpserver"
+	"github.com/Djoulzy/Polycom/urlcrypt"
 	"github.com/Djoulzy/Tools/clog"
 	"github.com/stretchr/testify/assert"
 )
@@ -16,7 +21,7 @@ var slist *ServersList
 
 func newClient(name string, userType int) *hub.Client {
 	tmpClient := &hub.Client{
-		Conn: "NoC", Consistent: make(chan bool), Quit: make(chan bool),
+		Quit:  make(chan bool, 8),
 		CType: userType, Send: make(chan []byte, 256),
 		CallToAction: nil, Addr: "10.31.100.200:8081",
 		Name: name, Content_id: 0, Front_id: "", App_id: "", Country: "", User_agent: "Test Socket",
@@ -38,7 +43,6 @@ func TestAddServer(t *testing.T) {
 func TestAddNewConnectedServer(t *testing.T) {
 	regSrv := newClient("test1", hub.ClientUndefined)
 	tmpHub.Register <- regSrv
-	<-regSrv.Consistent
 	tmpHub.Newrole(&hub.ConnModifier{Client: regSrv, NewName: "test1", NewType: hub.ClientServer})
 
 	slist.AddNewConnectedServer(regSrv)
@@ -66,11 +70,220 @@ func TestUpdateMetrics(t *testing.T) {
 func TestRedirectConnection(t *testing.T) {
 	tmpClient := newClient("Toto", hub.ClientUser)
 	tmpHub.Register <- tmpClient
-	<-tmpClient.Consistent
 
 	slist.RedirectConnection(tmpClient)
 	ret := <-tmpClient.Send
 	assert.Equal(t, "[RDCT]10.31.100.200:8080", string(ret), "Bad redirection data")
+	assert.Equal(t, []string{"10.31.100.200:8080"}, slist.HealthyBrothers(), "Only the connected brothers with free slots should be listed")
+}
+
+func TestUserLocation(t *testing.T) {
+	srv1 := newClient("brother1", hub.ClientServer)
+	srv2 := newClient("brother2", hub.ClientServer)
+
+	slist.ClaimSession("Titi", 1, srv1)
+	assert.Equal(t, srv1, slist.sessions["Titi"].Owner, "User location should be recorded")
+	assert.Nil(t, slist.GetUserLocation("Titi"), "Unregistered brother should not be returned")
+
+	slist.ForgetUser("Titi", srv2)
+	assert.Equal(t, srv1, slist.sessions["Titi"].Owner, "Location should only be forgotten for the right brother")
+
+	slist.ForgetUser("Titi", srv1)
+	assert.Nil(t, slist.sessions["Titi"], "User location should be forgotten")
+}
+
+func TestPublishToBrothers(t *testing.T) {
+	interested := newClient("interested", hub.ClientServer)
+	interested.Addr = "10.31.100.201:8081"
+	other := newClient("other", hub.ClientServer)
+	other.Addr = "10.31.100.202:8081"
+
+	tmpHub.Register <- interested
+	tmpHub.Register <- other
+	slist.AddNewConnectedServer(interested)
+	slist.AddNewConnectedServer(other)
+
+	slist.UpdateTopics(interested.Addr, []byte("[\"room1\"]"))
+	slist.UpdateTopics(other.Addr, []byte("[\"room2\"]"))
+	assert.Equal(t, true, slist.nodes[interested.Addr].topics["room1"], "Topics should be recorded")
+
+	slist.PublishToBrothers("room1", []byte("[PUBL]room1|Hello"))
+	ret := <-interested.Send
+	assert.Equal(t, "[PUBL]room1|Hello", string(ret), "Bad forwarded message")
+	assert.Equal(t, 0, len(other.Send), "Message should only reach interested brothers")
+}
+
+func TestBroadcastInterest(t *testing.T) {
+	withUsers := newClient("withUsers", hub.ClientServer)
+	withUsers.Addr = "10.31.100.203:8081"
+	without := newClient("without", hub.ClientServer)
+	without.Addr = "10.31.100.204:8081"
+
+	tmpHub.Register <- withUsers
+	tmpHub.Register <- without
+	slist.AddNewConnectedServer(withUsers)
+	slist.AddNewConnectedServer(without)
+
+	slist.UpdateTopics(withUsers.Addr, []byte("[\"appA/$broadcast\"]"))
+	slist.UpdateTopics(without.Addr, []byte("[\"appB/$broadcast\"]"))
+
+	slist.PublishToBrothers(hub.TenantName("appA", hub.BroadcastTopic), []byte("[BCST]appA|Hello"))
+	ret := <-withUsers.Send
+	assert.Equal(t, "[BCST]appA|Hello", string(ret), "Bad forwarded message")
+	assert.Equal(t, 0, len(without.Send), "Broadcast should only reach brothers with users of the app")
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 5*time.Second, slist.backoff(1), "First retry should wait one check period")
+	assert.Equal(t, 20*time.Second, slist.backoff(3), "Delay should double on each failure")
+	assert.Equal(t, maxBackoff, slist.backoff(50), "Delay should be capped")
+}
+
+func TestDialFailure(t *testing.T) {
+	slist.AddNewPotentialServer("down", "127.0.0.1:1")
+	defer func() {
+		slist.nodesMutex.Lock()
+		delete(slist.nodes, "127.0.0.1:1")
+		slist.nodesMutex.Unlock()
+	}()
+	assert.Equal(t, StateDisconnected, slist.nodes["127.0.0.1:1"].state, "New brother should be disconnected")
+
+	slist.dial("127.0.0.1:1")
+	node := slist.nodes["127.0.0.1:1"]
+	assert.Equal(t, StateBackoff, node.state, "Unreachable brother should be in backoff")
+	assert.Equal(t, 1, node.attempts, "Failed attempt should be counted")
+	assert.True(t, node.nextTry.After(time.Now()), "Next try should be delayed")
+}
+
+func TestAcceptLink(t *testing.T) {
+	inbound := newClient("Zed", hub.ClientUndefined)
+	tmpHub.Register <- inbound
+	tmpHub.Newrole(&hub.ConnModifier{Client: inbound, NewName: "Zed", NewType: hub.ClientServer})
+
+	outbound := newClient("Zed", hub.ClientUndefined)
+	outbound.Outbound = true
+	assert.True(t, slist.AcceptLink(outbound, "Zed"), "Link dialed by the smallest name should win")
+	assert.True(t, slist.AcceptLink(inbound, "Zed"), "Registered link should be accepted")
+
+	other := newClient("Abe", hub.ClientUndefined)
+	tmpHub.Register <- other
+	tmpHub.Newrole(&hub.ConnModifier{Client: other, NewName: "Abe", NewType: hub.ClientServer})
+
+	outbound = newClient("Abe", hub.ClientUndefined)
+	outbound.Outbound = true
+	assert.False(t, slist.AcceptLink(outbound, "Abe"), "Link dialed by the biggest name should be dropped")
+
+	reconnect := newClient("Abe", hub.ClientUndefined)
+	assert.True(t, slist.AcceptLink(reconnect, "Abe"), "Link in the same direction should replace the old one")
+}
+
+func TestHelloInbound(t *testing.T) {
+	inbound := newClient("Hal", hub.ClientUndefined)
+	tmpHub.Register <- inbound
+	assert.True(t, slist.IdentifyLink(inbound, "Hal", "10.31.100.205:8081"))
+
+	frame := <-inbound.Send
+	assert.True(t, strings.HasPrefix(string(frame), "[HELO]"), "Brother should be answered with our [HELO]")
+	clear, _ := slist.tcpmanager.Cryptor.Decrypt_b64(string(frame[6:]))
+	infos := strings.Split(string(clear), "|")
+	assert.Equal(t, "10.31.100.205:8081", infos[len(infos)-1], "[HELO] should be made for the brother TCPaddr")
+}
+
+func TestConcurrentLinks(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("Zulu%d", i)
+		outbound := newClient(name+"-out", hub.ClientUndefined)
+		outbound.Outbound = true
+		inbound := newClient(name+"-in", hub.ClientUndefined)
+		tmpHub.Register <- outbound
+		tmpHub.Register <- inbound
+
+		done := make(chan bool, 2)
+		for _, link := range []*hub.Client{outbound, inbound} {
+			go func(link *hub.Client) {
+				slist.IdentifyLink(link, name, link.Addr)
+				done <- true
+			}(link)
+		}
+		<-done
+		<-done
+		assert.Equal(t, outbound, tmpHub.GetClientByName(name, hub.ClientServer), "Link dialed by the smallest name should be kept")
+		assert.False(t, inbound.CType == hub.ClientServer && tmpHub.IsRegistered(inbound), "Other link should be dropped")
+	}
+}
+
+// nextFrame skips the interest announces ([TPCS]) sent when users come and go.
+func nextFrame(c *hub.Client) string {
+	for {
+		if frame := string(<-c.Send); !strings.HasPrefix(frame, "[TPCS]") {
+			return frame
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	brother := newClient("Brother", hub.ClientServer)
+	tmpHub.Register <- brother
+
+	user := newClient("sess1", hub.ClientUndefined)
+	tmpHub.Register <- user
+	version := slist.OpenSession(user, "app/Bob", "app")
+	assert.Equal(t, user, tmpHub.GetClientByName("app/Bob", hub.ClientUser), "Opening the session should identify the user")
+
+	assert.Nil(t, slist.ClaimSession("app/Bob", version-1, brother), "Older login should not close the local user")
+	assert.Equal(t, fmt.Sprintf("[SESS]app/Bob|%d", version), nextFrame(brother), "Brother should be told its session is older")
+	assert.Nil(t, slist.GetUserLocation("app/Bob"), "Local session should be kept")
+
+	assert.Equal(t, user, slist.ClaimSession("app/Bob", version+10, brother), "Newer login should supersede the local user")
+	assert.Equal(t, brother, slist.GetUserLocation("app/Bob"), "Directory should point to the new owner")
+	assert.Equal(t, 0, len(brother.Send), "Winner should not be answered")
+
+	again := newClient("sess2", hub.ClientUndefined)
+	tmpHub.Register <- again
+	version = slist.OpenSession(again, "app/Bob", "app")
+	assert.Equal(t, fmt.Sprintf("[SESS]app/Bob|%d", version), nextFrame(brother), "Previous owner should be told directly")
+
+	slist.CloseSession(user)
+	assert.NotNil(t, slist.sessions["app/Bob"], "Only the holder of a session can close it")
+	slist.CloseSession(again)
+	assert.Nil(t, slist.sessions["app/Bob"], "Session should be released when its user leaves")
+	assert.Equal(t, version, slist.closed["app/Bob"], "Release should be sent with the next digest")
+}
+
+func TestSessionsDigest(t *testing.T) {
+	brother := newClient("Digester", hub.ClientServer)
+	tmpHub.Register <- brother
+
+	superseded, err := slist.SyncSessions(brother, []byte(`{"Opened":{"app/Ann":5,"app/Joe":6}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(superseded))
+	assert.Equal(t, brother, slist.GetUserLocation("app/Ann"), "Digest should fill the directory")
+
+	slist.SyncSessions(brother, []byte(`{"Closed":{"app/Ann":4,"app/Joe":6}}`))
+	assert.Equal(t, brother, slist.GetUserLocation("app/Ann"), "Release of an older session should be ignored")
+	assert.Nil(t, slist.GetUserLocation("app/Joe"), "Released session should be forgotten")
+
+	link := newClient("Receiver", hub.ClientServer)
+	tmpHub.Register <- link
+	opened := make(map[string]uint64)
+	for i := 0; i < sessionsPerDigest+1; i++ {
+		opened[fmt.Sprintf("app/user%d", i)] = uint64(i + 1)
+	}
+	slist.sendDigest([]*hub.Client{link}, opened, map[string]uint64{"app/gone": 1})
+	lines := []string{string(<-link.Send), string(<-link.Send)}
+	size := 0
+	for _, line := range lines {
+		var digest SessionsDigest
+		assert.True(t, strings.HasPrefix(line, "[SDIR]"), "Bad digest line")
+		assert.Nil(t, json.Unmarshal([]byte(line[6:]), &digest))
+		size += len(digest.Opened) + len(digest.Closed)
+		assert.True(t, len(digest.Opened)+len(digest.Closed) <= sessionsPerDigest, "Digest should be split in lines")
+	}
+	assert.Equal(t, sessionsPerDigest+2, size, "Every session should be sent")
+
+	tmpHub.Unregister <- brother
+	slist.flushSessions()
+	assert.Nil(t, slist.sessions["app/Ann"], "Sessions of a lost brother should be dropped")
 }
 
 func TestMain(m *testing.M) {
@@ -89,7 +302,7 @@ func TestMain(m *testing.M) {
 		ScalingCheckServerPeriod: 5,
 		MaxServersConns:          5,
 		CallToAction:             nil,
-		Cryptor:                  nil,
+		Cryptor:                  &urlcrypt.Cypher{HASH_SIZE: 8, HEX_KEY: []byte("d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473")},
 	}
 
 	srvList := make(map[string]string)
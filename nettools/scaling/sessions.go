@@ -0,0 +1,246 @@
+package scaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Tools/clog"
+)
+
+// Session is the entry of a user in the directory. A login opens a session
+// with a version greater than all the ones known by its server. The newest
+// session wins, ties being broken by the owner name, and only the server
+// holding an older session closes its user.
+//
+// The previous owner of a user, when known, is told at once with
+// [SESS]<name>|<version>. Every brother learns the opened and closed sessions
+// from the [SDIR] digest sent each sessionsPeriod, so a login elsewhere is
+// superseded within that delay at worst. The lease of a session learned from
+// a brother lasts as long as the link to it.
+type Session struct {
+	Owner   *hub.Client // nil when the user is connected to this server
+	Version uint64
+
+	holder *hub.Client // User of a local session
+}
+
+// SessionsDigest is the payload of [SDIR], versions indexed by user name.
+type SessionsDigest struct {
+	Opened map[string]uint64 `json:",omitempty"`
+	Closed map[string]uint64 `json:",omitempty"`
+}
+
+var sessionsPeriod = time.Second
+
+// Max number of sessions in one [SDIR] line.
+const sessionsPerDigest = 500
+
+func (slist *ServersList) ownerName(sess *Session) string {
+	if sess.Owner == nil {
+		return slist.localName
+	}
+	return sess.Owner.Name
+}
+
+// newer tells if the session (version, owner) supersedes sess.
+func (slist *ServersList) newer(version uint64, owner string, sess *Session) bool {
+	if version != sess.Version {
+		return version > sess.Version
+	}
+	return owner > slist.ownerName(sess)
+}
+
+// OpenSession identifies c as the user name of app_id and records its session
+// in one step, so that a session announced meanwhile can't be missed.
+func (slist *ServersList) OpenSession(c *hub.Client, name string, app_id string) uint64 {
+	slist.sessionsMutex.Lock()
+	cur := slist.sessions[name]
+	version := uint64(time.Now().UnixNano())
+	if cur != nil && cur.Version >= version {
+		version = cur.Version + 1
+	}
+	slist.Hub.Newrole(&hub.ConnModifier{Client: c, NewName: name, NewType: hub.ClientUser, NewAppID: app_id})
+	slist.sessions[name] = &Session{Version: version, holder: c}
+	delete(slist.closed, name)
+	slist.opened[name] = version
+	slist.sessionsMutex.Unlock()
+
+	if cur != nil && cur.Owner != nil && slist.Hub.IsRegistered(cur.Owner) {
+		slist.Hub.Unicast <- hub.NewMessage(hub.ClientServer, cur.Owner, []byte(fmt.Sprintf("[SESS]%s|%d", name, version)))
+	}
+	return version
+}
+
+// CloseSession releases the session of a local user leaving the hub. It is
+// meant to be the hub OnLeave hook.
+func (slist *ServersList) CloseSession(c *hub.Client) {
+	slist.sessionsMutex.Lock()
+	defer slist.sessionsMutex.Unlock()
+
+	if sess := slist.sessions[c.Name]; sess != nil && sess.holder == c {
+		delete(slist.sessions, c.Name)
+		delete(slist.opened, c.Name)
+		slist.closed[c.Name] = sess.Version
+	}
+}
+
+// ClaimSession handles a session opened on the brother srv. It returns the
+// local user superseded by it, which must be disconnected, if any. When the
+// local session is the newest one, srv is told so it closes its own user.
+func (slist *ServersList) ClaimSession(name string, version uint64, srv *hub.Client) *hub.Client {
+	slist.sessionsMutex.Lock()
+	cur := slist.sessions[name]
+	var holder *hub.Client
+	if cur != nil && cur.holder != nil && slist.Hub.IsRegistered(cur.holder) {
+		holder = cur.holder
+	}
+
+	switch {
+	case cur == nil || slist.newer(version, srv.Name, cur):
+		slist.sessions[name] = &Session{Owner: srv, Version: version}
+		delete(slist.opened, name)
+		slist.sessionsMutex.Unlock()
+		return holder
+	case holder != nil:
+		slist.sessionsMutex.Unlock()
+		clog.Info("Scaling", "ClaimSession", "Session %s of %s is older than ours, keeping it", name, srv.Name)
+		slist.Hub.Unicast <- hub.NewMessage(hub.ClientServer, srv, []byte(fmt.Sprintf("[SESS]%s|%d", name, cur.Version)))
+		return nil
+	case cur.Owner == nil || !slist.Hub.IsRegistered(cur.Owner):
+		// The newer session has ended, its lease with it.
+		slist.sessions[name] = &Session{Owner: srv, Version: version}
+	}
+	slist.sessionsMutex.Unlock()
+	return nil
+}
+
+// ReleaseSession forgets a session closed on the brother srv.
+func (slist *ServersList) ReleaseSession(name string, version uint64, srv *hub.Client) {
+	slist.sessionsMutex.Lock()
+	if sess := slist.sessions[name]; sess != nil && sess.Owner == srv && sess.Version == version {
+		delete(slist.sessions, name)
+	}
+	slist.sessionsMutex.Unlock()
+}
+
+// SyncSessions applies a [SDIR] digest of srv and returns the local users
+// superseded by it.
+func (slist *ServersList) SyncSessions(srv *hub.Client, message []byte) ([]*hub.Client, error) {
+	var digest SessionsDigest
+	if err := json.Unmarshal(message, &digest); err != nil {
+		return nil, err
+	}
+	for name, version := range digest.Closed {
+		slist.ReleaseSession(name, version, srv)
+	}
+	var superseded []*hub.Client
+	for name, version := range digest.Opened {
+		if holder := slist.ClaimSession(name, version, srv); holder != nil {
+			superseded = append(superseded, holder)
+		}
+	}
+	return superseded, nil
+}
+
+// sendDigest sends the sessions in lines of at most sessionsPerDigest entries.
+func (slist *ServersList) sendDigest(links []*hub.Client, opened map[string]uint64, closed map[string]uint64) {
+	var lines [][]byte
+	digest := SessionsDigest{Opened: make(map[string]uint64), Closed: make(map[string]uint64)}
+	size := 0
+	flush := func() {
+		if size > 0 {
+			line, _ := json.Marshal(digest)
+			lines = append(lines, append([]byte("[SDIR]"), line...))
+			digest = SessionsDigest{Opened: make(map[string]uint64), Closed: make(map[string]uint64)}
+			size = 0
+		}
+	}
+	for name, version := range opened {
+		digest.Opened[name] = version
+		if size++; size == sessionsPerDigest {
+			flush()
+		}
+	}
+	for name, version := range closed {
+		digest.Closed[name] = version
+		if size++; size == sessionsPerDigest {
+			flush()
+		}
+	}
+	flush()
+
+	for _, link := range links {
+		for _, line := range lines {
+			slist.Hub.Unicast <- hub.NewMessage(hub.ClientServer, link, line)
+		}
+	}
+}
+
+// flushSessions sends the sessions opened and closed since the last call to
+// the brothers, and drops the sessions of lost brothers.
+func (slist *ServersList) flushSessions() {
+	slist.sessionsMutex.Lock()
+	opened, closed := slist.opened, slist.closed
+	slist.opened, slist.closed = make(map[string]uint64), make(map[string]uint64)
+	alive := make(map[*hub.Client]bool)
+	for name, sess := range slist.sessions {
+		if sess.Owner == nil {
+			continue
+		}
+		registered, checked := alive[sess.Owner]
+		if !checked {
+			registered = slist.Hub.IsRegistered(sess.Owner)
+			alive[sess.Owner] = registered
+		}
+		if !registered {
+			delete(slist.sessions, name)
+		}
+	}
+	slist.sessionsMutex.Unlock()
+
+	if len(opened)+len(closed) > 0 {
+		slist.sendDigest(slist.brothers(func(node *NearbyServer) bool { return true }), opened, closed)
+	}
+}
+
+// sendSessions sends all the local sessions to a brother which just joined.
+func (slist *ServersList) sendSessions(link *hub.Client) {
+	slist.sessionsMutex.Lock()
+	opened := make(map[string]uint64)
+	for name, sess := range slist.sessions {
+		if sess.Owner == nil {
+			opened[name] = sess.Version
+		}
+	}
+	slist.sessionsMutex.Unlock()
+
+	slist.sendDigest([]*hub.Client{link}, opened, nil)
+}
+
+// GetUserLocation returns the brother holding a user, or nil if the user is
+// unknown, local, or if the link to its server is gone.
+func (slist *ServersList) GetUserLocation(name string) *hub.Client {
+	slist.sessionsMutex.Lock()
+	var srv *hub.Client
+	if sess := slist.sessions[name]; sess != nil {
+		srv = sess.Owner
+	}
+	slist.sessionsMutex.Unlock()
+
+	if srv == nil || !slist.Hub.IsRegistered(srv) {
+		return nil
+	}
+	return srv
+}
+
+// ForgetUser drops the session of a user. If srv is not nil, the entry is
+// only removed when it still points to that brother.
+func (slist *ServersList) ForgetUser(name string, srv *hub.Client) {
+	slist.sessionsMutex.Lock()
+	if sess := slist.sessions[name]; sess != nil && (srv == nil || sess.Owner == srv) {
+		delete(slist.sessions, name)
+	}
+	slist.sessionsMutex.Unlock()
+}
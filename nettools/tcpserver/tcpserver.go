@@ -3,13 +3,15 @@ package tcpserver
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"crypto/tls"
+	"errors"
 	"net"
 	"sync"
 	"time"
 
 	// "github.com/davecgh/go-spew/spew"
 	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/nettools/tlsconf"
 	"github.com/Djoulzy/Polycom/urlcrypt"
 	"github.com/Djoulzy/Tools/clog"
 )
@@ -19,6 +21,16 @@ var (
 	Space   = []byte{' '}
 )
 
+// Heartbeat frames, answered by the transport and never given to CallToAction.
+var (
+	PingFrame = []byte("[PING]")
+	PongFrame = []byte("[PONG]")
+)
+
+const DefaultMaxLineLength = 64 * 1024
+
+var ErrLineTooLong = errors.New("tcpserver: line too long")
+
 type Manager struct {
 	Tcpaddr                  string
 	ServerName               string
@@ -26,37 +38,141 @@ type Manager struct {
 	MaxServersConns          int
 	ConnectTimeOut           int
 	WriteTimeOut             int
+	ReadTimeOut              int // A peer silent for ReadTimeOut seconds is dead, 0 to disable
+	PingPeriod               int // Seconds between two [PING], 0 to disable
+	MaxLineLength            int
 	ScalingCheckServerPeriod int
 	CallToAction             func(*hub.Client, []byte)
 	Cryptor                  *urlcrypt.Cypher
+	TLS                      *tlsconf.Params // Mutual TLS between brothers when set
+
+	listener      net.Listener
+	listenerMutex sync.Mutex
+	closing       bool
+}
+
+// lineReader reads the '\n' terminated lines of a connection, keeping its
+// buffer between two lines.
+type lineReader struct {
+	r   *bufio.Reader
+	max int
+}
+
+func newLineReader(conn net.Conn, max int) *lineReader {
+	if max <= 0 {
+		max = DefaultMaxLineLength
+	}
+	return &lineReader{r: bufio.NewReader(conn), max: max}
+}
+
+func (lr *lineReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := lr.r.ReadSlice('\n')
+		if len(line)+len(chunk) > lr.max {
+			return nil, ErrLineTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// escapeLine makes a message fit on one line of the mesh : backslashes, line
+// feeds and carriage returns are sent as a backslash followed by '\\', 'n' or 'r'.
+func escapeLine(message []byte) []byte {
+	if bytes.IndexAny(message, "\\\n\r") < 0 {
+		return message
+	}
+	line := make([]byte, 0, len(message)+8)
+	for _, b := range message {
+		switch b {
+		case '\\':
+			line = append(line, '\\', '\\')
+		case '\n':
+			line = append(line, '\\', 'n')
+		case '\r':
+			line = append(line, '\\', 'r')
+		default:
+			line = append(line, b)
+		}
+	}
+	return line
 }
 
-func (m *Manager) reader(conn *net.TCPConn, cli *hub.Client) {
+// unescapeLine is the reverse of escapeLine.
+func unescapeLine(line []byte) []byte {
+	if bytes.IndexByte(line, '\\') < 0 {
+		return line
+	}
+	message := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		if line[i] != '\\' || i == len(line)-1 {
+			message = append(message, line[i])
+			continue
+		}
+		i++
+		switch line[i] {
+		case 'n':
+			message = append(message, '\n')
+		case 'r':
+			message = append(message, '\r')
+		default:
+			message = append(message, line[i])
+		}
+	}
+	return message
+}
+
+func (m *Manager) setDeadline(set func(time.Time) error, seconds int) {
+	if seconds > 0 {
+		set(time.Now().Add(time.Second * time.Duration(seconds)))
+	}
+}
+
+// reader gives the lines of the peer to CallToAction. Any line, [PONG]
+// included, pushes the read deadline back. [PING] is answered by the writer.
+func (m *Manager) reader(conn net.Conn, cli *hub.Client, ping chan<- bool) {
 	defer func() {
 		conn.Close()
 	}()
 
-	// message := make([]byte, 1024)
+	lr := newLineReader(conn, m.MaxLineLength)
 	for {
-		// conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-		message, err := bufio.NewReader(conn).ReadBytes('\n')
+		m.setDeadline(conn.SetReadDeadline, m.ReadTimeOut)
+		message, err := lr.readLine()
 		if err != nil {
 			clog.Trace("TCPserver", "reader", "closing conn %s", err)
 			break
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, Newline, Space, -1))
-		// clog.Trace("TCPserver", "reader", "Reading %s", message)
-		// long, err := conn.Read(message)
-		// if err != nil {
-		// 	break
-		// }
-		// message = message[:long-1]
-		// spew.Dump(message)
-		go m.CallToAction(cli, message)
+		message = unescapeLine(bytes.TrimRight(message, "\r\n"))
+		switch {
+		case len(message) == 0, bytes.Equal(message, PongFrame):
+		case bytes.Equal(message, PingFrame):
+			select {
+			case ping <- true:
+			default:
+			}
+		default:
+			go m.CallToAction(cli, message)
+		}
 	}
 }
 
-func (m *Manager) writer(conn *net.TCPConn, cli *hub.Client) {
+func (m *Manager) write(conn net.Conn, message []byte) error {
+	m.setDeadline(conn.SetWriteDeadline, m.WriteTimeOut)
+	_, err := conn.Write(append(escapeLine(message), Newline...))
+	return err
+}
+
+func (m *Manager) writer(conn net.Conn, cli *hub.Client, ping <-chan bool) {
+	var heartbeat <-chan time.Time
+	if m.PingPeriod > 0 {
+		ticker := time.NewTicker(time.Second * time.Duration(m.PingPeriod))
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
 	defer func() {
 		conn.Close()
 	}()
@@ -65,6 +181,7 @@ func (m *Manager) writer(conn *net.TCPConn, cli *hub.Client) {
 		select {
 		case <-cli.Quit:
 			clog.Trace("TCPserver", "writer", "closing conn")
+			m.flush(conn, cli)
 			return
 		case message, ok := <-cli.Send:
 			// clog.Debug("TCPserver", "writer", "Sending %s", message)
@@ -72,14 +189,35 @@ func (m *Manager) writer(conn *net.TCPConn, cli *hub.Client) {
 				// The hub closed the channel.
 				return
 			}
+			if err := m.write(conn, message); err != nil {
+				return
+			}
+		case <-ping:
+			if err := m.write(conn, PongFrame); err != nil {
+				return
+			}
+		case <-heartbeat:
+			if err := m.write(conn, PingFrame); err != nil {
+				clog.Warn("TCPserver", "writer", "Cannot ping %s: %s", cli.Name, err)
+				return
+			}
+		}
+	}
+}
 
-			err := conn.SetWriteDeadline(time.Now().Add(time.Second))
-			if err != nil {
-
+// flush writes the messages still queued for a client which is being disconnected.
+func (m *Manager) flush(conn net.Conn, cli *hub.Client) {
+	for {
+		select {
+		case message, ok := <-cli.Send:
+			if !ok {
 				return
 			}
-			message = append(message, Newline...)
-			conn.Write(message)
+			if err := m.write(conn, message); err != nil {
+				return
+			}
+		default:
+			return
 		}
 	}
 }
@@ -90,68 +228,146 @@ func (m *Manager) writer(conn *net.TCPConn, cli *hub.Client) {
 // 	return ip[0]
 // }
 
-func (m *Manager) Connect(addr string) (*net.TCPConn, error) {
-	conn, err := net.DialTimeout("tcp", addr, time.Second*time.Duration(m.ConnectTimeOut))
+func (m *Manager) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Second * time.Duration(m.ConnectTimeOut)}
+	if !m.TLS.Enabled() {
+		return dialer.Dial("tcp", addr)
+	}
+
+	conf, err := tlsconf.ClientConfig(m.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, conf)
+}
+
+func (m *Manager) listen() (net.Listener, error) {
+	if !m.TLS.Enabled() {
+		return net.Listen("tcp", m.Tcpaddr)
+	}
+
+	conf, err := tlsconf.MutualServerConfig(m.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", m.Tcpaddr, conf)
+}
+
+// handshake makes sure an incomming TLS peer is trusted before it reaches the hub.
+func (m *Manager) handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	m.setDeadline(conn.SetDeadline, m.ConnectTimeOut)
+	defer conn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
+
+func (m *Manager) Connect(addr string) (net.Conn, error) {
+	conn, err := m.dial(addr)
 	// addr, _ := net.ResolveTCPAddr("tcp", m.Tcpaddr)
 	// conn, err := net.DialTCP("tcp", nil, addr)
 	if err != nil {
-		clog.Error("TCPserver", "Connect", "Can't connect to server %s", addr)
+		clog.Error("TCPserver", "Connect", "Can't connect to server %s: %s", addr, err)
 		return nil, err
 	}
-	return conn.(*net.TCPConn), err
+	return conn, err
 }
 
-func (m *Manager) newClient(addr string, name string) *hub.Client {
-	client := &hub.Client{Quit: make(chan bool),
+func (m *Manager) newClient(addr string, name string, outbound bool) *hub.Client {
+	client := &hub.Client{Quit: make(chan bool, 1),
 		CType: hub.ClientUndefined, Send: make(chan []byte, 256), CallToAction: m.CallToAction, Addr: addr,
-		Name: name, Content_id: 0, Front_id: "", App_id: "", Country: "", User_agent: "TCP Socket"}
+		Name: name, Content_id: 0, Front_id: "", App_id: "", Country: "", User_agent: "TCP Socket", Outbound: outbound}
 	m.Hub.Register <- client
 	// <-client.Consistent
 	return client
 }
 
-func (m *Manager) NewOutgoingConn(conn *net.TCPConn, toName string, wg *sync.WaitGroup) {
-	clog.Debug("TCPserver", "NewOutgoingConn", "Contacting %s", conn.RemoteAddr().String())
-	client := m.newClient(conn.RemoteAddr().String(), toName)
-	handShake, _ := m.Cryptor.Encrypt_b64(fmt.Sprintf("%s|%s|SERV", m.ServerName, m.Tcpaddr))
+// Hello sends the [HELO] of this server to the brother listening on toAddr.
+func (m *Manager) Hello(client *hub.Client, toAddr string) {
+	handShake, _ := m.Cryptor.NewHandshake(m.ServerName, m.Tcpaddr, "SERV", toAddr)
 	mess := hub.NewMessage(client.CType, client, append([]byte("[HELO]"), handShake...))
 	m.Hub.Unicast <- mess
+}
 
-	go m.writer(conn, client)
+func (m *Manager) NewOutgoingConn(conn net.Conn, toName string, wg *sync.WaitGroup) {
+	clog.Debug("TCPserver", "NewOutgoingConn", "Contacting %s", conn.RemoteAddr().String())
+	client := m.newClient(conn.RemoteAddr().String(), toName, true)
+	m.Hello(client, client.Addr)
+
+	ping := make(chan bool, 1)
+	go m.writer(conn, client, ping)
 	(*wg).Done()
-	m.reader(conn, client)
+	m.reader(conn, client, ping)
 	m.Hub.Unregister <- client
 	// <-client.Consistent
 }
 
-func (m *Manager) NewIncommingConn(conn *net.TCPConn, wg *sync.WaitGroup) {
-	client := m.newClient(conn.RemoteAddr().String(), conn.RemoteAddr().String())
-	handShake, _ := m.Cryptor.Encrypt_b64(fmt.Sprintf("%s|%s|SERV", m.ServerName, m.Tcpaddr))
-	mess := hub.NewMessage(client.CType, client, append([]byte("[HELO]"), handShake...))
-	m.Hub.Unicast <- mess
+func (m *Manager) NewIncommingConn(conn net.Conn, wg *sync.WaitGroup) {
+	if err := m.handshake(conn); err != nil {
+		clog.Warn("TCPserver", "NewIncommingConn", "TLS handshake failed with %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		(*wg).Done()
+		return
+	}
+
+	// Our [HELO] is only sent once the brother told its TCPaddr, see
+	// scaling.IdentifyLink.
+	client := m.newClient(conn.RemoteAddr().String(), conn.RemoteAddr().String(), false)
 
-	go m.writer(conn, client)
+	ping := make(chan bool, 1)
+	go m.writer(conn, client, ping)
 	(*wg).Done()
-	m.reader(conn, client)
+	m.reader(conn, client, ping)
 	m.Hub.Unregister <- client
 	// <-client.Consistent
 }
 
+func (m *Manager) stopped() bool {
+	m.listenerMutex.Lock()
+	defer m.listenerMutex.Unlock()
+	return m.closing
+}
+
+// Stop closes the listener, the established links are kept.
+func (m *Manager) Stop() error {
+	m.listenerMutex.Lock()
+	defer m.listenerMutex.Unlock()
+	m.closing = true
+	if m.listener == nil {
+		return nil
+	}
+	return m.listener.Close()
+}
+
 func (m *Manager) Start(conf *Manager) {
 	var wg sync.WaitGroup
 
 	m = conf
 
-	formatedaddr, _ := net.ResolveTCPAddr("tcp", m.Tcpaddr)
-	ln, err := net.ListenTCP("tcp", formatedaddr)
+	ln, err := m.listen()
 	if err != nil {
 		clog.Error("TCPserver", "Start", "%s", err)
+		return
+	}
+
+	m.listenerMutex.Lock()
+	m.listener = ln
+	if m.closing {
+		ln.Close()
 	}
+	m.listenerMutex.Unlock()
 
 	for {
-		conn, err := ln.AcceptTCP()
+		conn, err := ln.Accept()
 		if err != nil {
-			// handle error
+			if m.stopped() {
+				clog.Info("TCPserver", "Start", "Listener on %s closed", m.Tcpaddr)
+				return
+			}
+			clog.Error("TCPserver", "Start", "%s", err)
+			continue
 		}
 		wg.Add(1)
 		go m.NewIncommingConn(conn, &wg)
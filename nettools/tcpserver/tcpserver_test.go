@@ -0,0 +1,269 @@
+package tcpserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Polycom/nettools/tlsconf"
+	"github.com/Djoulzy/Tools/clog"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient() *hub.Client {
+	return &hub.Client{Name: "TCPTest", CType: hub.ClientServer, Send: make(chan []byte, 8), Quit: make(chan bool, 1)}
+}
+
+func TestReadLine(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	go func() {
+		remote.Write([]byte("[BCST]one\r\n[BCST]two\n[BCST]" + strings.Repeat("x", 100) + "\n"))
+	}()
+
+	lr := newLineReader(local, 64)
+	line, err := lr.readLine()
+	assert.Nil(t, err)
+	assert.Equal(t, "[BCST]one\r\n", string(line), "Bad first line")
+	line, err = lr.readLine()
+	assert.Nil(t, err)
+	assert.Equal(t, "[BCST]two\n", string(line), "Back to back lines should not be lost")
+	_, err = lr.readLine()
+	assert.Equal(t, ErrLineTooLong, err)
+}
+
+func TestHeartbeat(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	received := make(chan string, 8)
+	m := &Manager{
+		WriteTimeOut: 1,
+		ReadTimeOut:  5,
+		CallToAction: func(c *hub.Client, message []byte) { received <- string(message) },
+	}
+	cli := newTestClient()
+	ping := make(chan bool, 1)
+	go m.writer(local, cli, ping)
+	go m.reader(local, cli, ping)
+
+	remote.SetDeadline(time.Now().Add(2 * time.Second))
+	peer := bufio.NewReader(remote)
+
+	remote.Write([]byte("[PING]\n[PONG]\n[MNIT]{}\n"))
+	line, err := peer.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "[PONG]\r\n", line, "[PING] should be answered")
+	assert.Equal(t, "[MNIT]{}", <-received, "Heartbeat frames should not reach CallToAction")
+
+	cli.Send <- []byte("[BCST]hello")
+	line, err = peer.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "[BCST]hello\r\n", line, "Bad written line")
+
+	cli.Quit <- true
+}
+
+func TestEscapedPayload(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	received := make(chan string, 8)
+	m := &Manager{
+		WriteTimeOut: 1,
+		CallToAction: func(c *hub.Client, message []byte) { received <- string(message) },
+	}
+	sender := newTestClient()
+	go m.writer(local, sender, nil)
+	go m.reader(remote, newTestClient(), make(chan bool, 1))
+
+	relay := "[PUBL]app|room1|{\"a\":\"line1\nline2\r\"}\\n"
+	sender.Send <- []byte(relay)
+	sender.Send <- []byte("[BCST]app|next")
+	// Commands are dispatched concurrently, their order is not kept.
+	got := []string{<-received, <-received}
+	assert.Contains(t, got, relay, "Payload with new lines should cross the mesh as one command")
+	assert.Contains(t, got, "[BCST]app|next", "Next command should not be broken")
+
+	assert.Equal(t, "a\\nb\\\\c", string(escapeLine([]byte("a\nb\\c"))))
+	sender.Quit <- true
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert writes a PEM certificate and key in dir, signed by parent or self-signed.
+func newCert(t *testing.T, dir string, name string, parent *testCert) (*testCert, *tlsconf.Params) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer := &testCert{cert: tmpl, key: key}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &tlsconf.Params{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	if err := os.WriteFile(p.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}, p
+}
+
+func TestDeadWriter(t *testing.T) {
+	h := hub.NewHub()
+	go h.Run()
+	defer func() { h.Done <- true }()
+
+	local, remote := net.Pipe()
+	m := &Manager{Hub: h, WriteTimeOut: 1}
+	cli := m.newClient("pipe", "deadwriter", false)
+	stopped := make(chan bool)
+	go func() {
+		m.writer(local, cli, nil)
+		stopped <- true
+	}()
+
+	remote.Close()
+	cli.Send <- []byte("[BCST]lost")
+	<-stopped
+
+	h.Unregister <- cli
+	done := make(chan bool)
+	go func() { done <- h.GetClientByName("deadwriter", hub.ClientUndefined) == nil }()
+	select {
+	case unregistered := <-done:
+		assert.True(t, unregistered, "Client should be unregistered")
+	case <-time.After(time.Second):
+		t.Fatal("Hub should not wait for a dead writer")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caFiles := newCert(t, dir, "ca", nil)
+	_, node1 := newCert(t, dir, "node1", ca)
+	_, node2 := newCert(t, dir, "node2", ca)
+	_, rogue := newCert(t, dir, "rogue", nil)
+	for _, p := range []*tlsconf.Params{node1, node2, rogue} {
+		p.CAFile = caFiles.CertFile
+	}
+
+	unchecked := &Manager{Tcpaddr: "127.0.0.1:0", TLS: &tlsconf.Params{CertFile: node1.CertFile, KeyFile: node1.KeyFile}}
+	_, err := unchecked.listen()
+	assert.Equal(t, tlsconf.ErrNoCA, err, "Mesh TLS without CA should not listen")
+
+	server := &Manager{Tcpaddr: "127.0.0.1:0", ConnectTimeOut: 2, TLS: node1}
+	ln, err := server.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	handshakes := make(chan error, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- server.handshake(conn)
+			conn.Close()
+		}
+	}()
+
+	brother := &Manager{ConnectTimeOut: 2, TLS: node2}
+	conn, err := brother.dial(ln.Addr().String())
+	assert.Nil(t, err, "Brothers signed by the CA should connect")
+	assert.Nil(t, <-handshakes, "Brothers signed by the CA should be accepted")
+	conn.Close()
+
+	intruder := &Manager{ConnectTimeOut: 2, TLS: rogue}
+	conn, err = intruder.dial(ln.Addr().String())
+	if err == nil {
+		// The client side can succeed before the server checks its certificate
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	assert.NotNil(t, <-handshakes, "Nodes not signed by the CA should be refused")
+
+	conn, err = (&Manager{ConnectTimeOut: 2}).dial(ln.Addr().String())
+	assert.Nil(t, err, "Plain TCP dial is still possible")
+	conn.Write([]byte("[HELO]plain\n"))
+	conn.Close()
+	assert.NotNil(t, <-handshakes, "Plain TCP peers should be refused by a TLS mesh")
+}
+
+func TestStop(t *testing.T) {
+	m := &Manager{Tcpaddr: "127.0.0.1:0"}
+	done := make(chan bool)
+	go func() {
+		m.Start(m)
+		done <- true
+	}()
+
+	for ready := false; !ready; time.Sleep(time.Millisecond) {
+		m.listenerMutex.Lock()
+		ready = m.listener != nil
+		m.listenerMutex.Unlock()
+	}
+	assert.Nil(t, m.Stop(), "Listener should close")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Start should return once stopped")
+	}
+}
+
+func TestMain(m *testing.M) {
+	clog.LogLevel = 5
+	clog.StartLogging = false
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,94 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	ErrBadCA = errors.New("tlsconf: no certificate found in CA file")
+	ErrNoCA  = errors.New("tlsconf: a CA file is required to check the peers certificates")
+)
+
+// Params locates the PEM files of a node. Without CAFile, the system roots
+// are used and peers are not asked for a certificate.
+type Params struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func (p *Params) Enabled() bool {
+	return p != nil && p.CertFile != "" && p.KeyFile != ""
+}
+
+// CheckMutual returns ErrNoCA when TLS is enabled without a CA: the peers
+// would not be asked for a certificate.
+func (p *Params) CheckMutual() error {
+	if p.Enabled() && p.CAFile == "" {
+		return ErrNoCA
+	}
+	return nil
+}
+
+func loadCA(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrBadCA
+	}
+	return pool, nil
+}
+
+// ServerConfig is used by the listeners. With a CA, peers must present a
+// certificate signed by it (mutual TLS).
+func ServerConfig(p *Params) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if p.CAFile != "" {
+		if conf.ClientCAs, err = loadCA(p.CAFile); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// MutualServerConfig is ServerConfig for the listeners which must check
+// their peers, it fails without a CA.
+func MutualServerConfig(p *Params) (*tls.Config, error) {
+	if err := p.CheckMutual(); err != nil {
+		return nil, err
+	}
+	return ServerConfig(p)
+}
+
+// ClientConfig is used to dial a brother : it presents the node certificate
+// and only trusts servers signed by the CA.
+func ClientConfig(p *Params) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if p.CAFile != "" {
+		if conf.RootCAs, err = loadCA(p.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,56 @@
+package protocol
+
+// Replies to the commands sent with a message id.
+const (
+	VerbAck  = "[ACK_]"
+	VerbNack = "[NACK]"
+)
+
+// Error codes of [NACK]#<id>|<code>
+const (
+	CodeUnknownVerb = "UNKNOWN"
+	CodeForbidden   = "DENIED"
+	CodeBadPayload  = "BADPAYLOAD"
+	CodeNotFound    = "NOTFOUND"
+	CodeHandshake   = "HANDSHAKE"
+	CodeFailed      = "FAILED"
+)
+
+func ErrorCode(err error) string {
+	switch err {
+	case ErrUnknownVerb:
+		return CodeUnknownVerb
+	case ErrForbidden:
+		return CodeForbidden
+	case ErrBadPayload:
+		return CodeBadPayload
+	case ErrNotFound:
+		return CodeNotFound
+	case ErrHandshakeMissing:
+		return CodeHandshake
+	default:
+		return CodeFailed
+	}
+}
+
+func withID(verb string, id string, payload []byte) []byte {
+	message := make([]byte, 0, VerbSize+len(id)+2+len(payload))
+	message = append(message, verb...)
+	message = append(message, '#')
+	message = append(message, id...)
+	if len(payload) > 0 {
+		message = append(message, '|')
+		message = append(message, payload...)
+	}
+	return message
+}
+
+// Ack returns [ACK_]#<id> or [ACK_]#<id>|<response>
+func Ack(id string, response []byte) []byte {
+	return withID(VerbAck, id, response)
+}
+
+// Nack returns [NACK]#<id>|<code>
+func Nack(id string, err error) []byte {
+	return withID(VerbNack, id, []byte(ErrorCode(err)))
+}
@@ -0,0 +1,262 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Framings a client can ask for at [HELO] : [HELO]<token>|<framing>.
+// Whatever the framing, messages in the legacy text form are still accepted.
+// Framed clients are served by the websocket server, the TCP mesh keeps the
+// text form.
+//
+// Clients which asked for a framing other than text can also send message ids
+// in the text form : [VERB]#<id>|<payload> (or [VERB]#<id> without payload).
+// For the others, a payload starting with '#' is a payload like any other.
+const (
+	FramingText   = 0 // [VERB]payload
+	FramingJSON   = 1 // {"v":1,"verb":"VERB","id":"","topic":"","payload":"<base64>"}
+	FramingBinary = 2 // see encodeBinary
+	FramingTextID = 3 // [VERB]payload or [VERB]#<id>|payload
+)
+
+// FrameV1 is the version of the JSON envelope, and the first byte of binary frames.
+const FrameV1 = 1
+
+var (
+	ErrBadFrame   = errors.New("protocol: malformed frame")
+	ErrBadVersion = errors.New("protocol: unknown frame version")
+	ErrBadFraming = errors.New("protocol: unknown framing")
+)
+
+var framingNames = map[string]int{
+	"text":   FramingText,
+	"json":   FramingJSON,
+	"binary": FramingBinary,
+	"textid": FramingTextID,
+}
+
+func ParseFraming(name string) (int, error) {
+	if framing, ok := framingNames[strings.ToLower(name)]; ok {
+		return framing, nil
+	}
+	return FramingText, ErrBadFraming
+}
+
+// Frame is a decoded message. Verb is the 6 bytes form ("[BCST]") or empty
+// for messages without verb, like the metrics sent to monitors.
+// Topic carries the first field of the command (topic, destination...) so
+// that it doesn't need to be separated from the payload by a '|'.
+type Frame struct {
+	Verb    string
+	ID      string
+	Topic   string
+	Payload []byte
+}
+
+// Body returns the command payload as in the text form : <topic>|<payload>.
+func (f *Frame) Body() []byte {
+	if f.Topic == "" {
+		return f.Payload
+	}
+	body := make([]byte, 0, len(f.Topic)+1+len(f.Payload))
+	body = append(body, f.Topic...)
+	body = append(body, '|')
+	return append(body, f.Payload...)
+}
+
+type jsonFrame struct {
+	V       int    `json:"v"`
+	Verb    string `json:"verb,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// AcceptsIDs tells if text messages of a client with this framing can start
+// with a message id.
+func AcceptsIDs(framing int) bool {
+	return framing != FramingText
+}
+
+// Decode reads a message in any of the framings, guessed from its first byte.
+// Message ids of the text form are only read when ids is set.
+func Decode(message []byte, ids bool) (*Frame, error) {
+	if len(message) == 0 {
+		return nil, ErrTooShort
+	}
+
+	var frame *Frame
+	var err error
+	switch message[0] {
+	case '{':
+		frame, err = decodeJSON(message)
+	case FrameV1:
+		frame, err = decodeBinary(message)
+	default:
+		if len(message) < VerbSize {
+			return nil, ErrTooShort
+		}
+		return decodeText(message, ids), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(frame.Topic, "|") {
+		return nil, ErrBadFrame
+	}
+	return frame, nil
+}
+
+func decodeText(message []byte, ids bool) *Frame {
+	frame := &Frame{Verb: string(message[:VerbSize]), Payload: message[VerbSize:]}
+	if ids && len(frame.Payload) > 0 && frame.Payload[0] == '#' {
+		id := frame.Payload[1:]
+		frame.Payload = nil
+		if i := bytes.IndexByte(id, '|'); i >= 0 {
+			id, frame.Payload = id[:i], id[i+1:]
+		}
+		frame.ID = string(id)
+	}
+	return frame
+}
+
+func shortVerb(verb string) string {
+	if validVerb(verb) {
+		return verb[1 : VerbSize-1]
+	}
+	return ""
+}
+
+func longVerb(verb string) (string, error) {
+	switch len(verb) {
+	case 0:
+		return "", nil
+	case VerbSize - 2:
+		return "[" + verb + "]", nil
+	default:
+		return "", ErrBadFrame
+	}
+}
+
+func decodeJSON(message []byte) (*Frame, error) {
+	var envelope jsonFrame
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, ErrBadFrame
+	}
+	if envelope.V != FrameV1 {
+		return nil, ErrBadVersion
+	}
+	verb, err := longVerb(envelope.Verb)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{Verb: verb, ID: envelope.ID, Topic: envelope.Topic, Payload: envelope.Payload}, nil
+}
+
+// Binary frames : <version:1> <verb:4> <id_len:2> <id> <topic_len:2> <topic> <payload_len:4> <payload>
+// Lengths are big endian. A verb of 4 zero bytes means no verb.
+func decodeBinary(message []byte) (*Frame, error) {
+	if message[0] != FrameV1 {
+		return nil, ErrBadVersion
+	}
+	data := message[1:]
+	if len(data) < VerbSize-2 {
+		return nil, ErrBadFrame
+	}
+
+	frame := &Frame{}
+	if verb := data[:VerbSize-2]; string(verb) != "\x00\x00\x00\x00" {
+		frame.Verb = "[" + string(verb) + "]"
+	}
+	data = data[VerbSize-2:]
+
+	var id, topic []byte
+	var ok bool
+	if id, data, ok = readField(data, 2); !ok {
+		return nil, ErrBadFrame
+	}
+	if topic, data, ok = readField(data, 2); !ok {
+		return nil, ErrBadFrame
+	}
+	if frame.Payload, data, ok = readField(data, 4); !ok || len(data) != 0 {
+		return nil, ErrBadFrame
+	}
+	frame.ID = string(id)
+	frame.Topic = string(topic)
+	return frame, nil
+}
+
+func readField(data []byte, size int) ([]byte, []byte, bool) {
+	if len(data) < size {
+		return nil, nil, false
+	}
+	var length uint64
+	if size == 2 {
+		length = uint64(binary.BigEndian.Uint16(data))
+	} else {
+		length = uint64(binary.BigEndian.Uint32(data))
+	}
+	data = data[size:]
+	if uint64(len(data)) < length {
+		return nil, nil, false
+	}
+	return data[:length], data[length:], true
+}
+
+// Encode writes a frame with the given framing.
+func Encode(framing int, frame *Frame) []byte {
+	switch framing {
+	case FramingJSON:
+		envelope := jsonFrame{V: FrameV1, Verb: shortVerb(frame.Verb), ID: frame.ID, Topic: frame.Topic, Payload: frame.Payload}
+		message, _ := json.Marshal(envelope)
+		return message
+	case FramingBinary:
+		return encodeBinary(frame)
+	default:
+		if frame.ID != "" {
+			return withID(frame.Verb, frame.ID, frame.Body())
+		}
+		message := make([]byte, 0, len(frame.Verb)+len(frame.Body()))
+		message = append(message, frame.Verb...)
+		return append(message, frame.Body()...)
+	}
+}
+
+func encodeBinary(frame *Frame) []byte {
+	message := make([]byte, 1+4+2+len(frame.ID)+2+len(frame.Topic)+4+len(frame.Payload))
+	message[0] = FrameV1
+	if verb := shortVerb(frame.Verb); verb != "" {
+		copy(message[1:5], verb)
+	}
+	pos := 5
+	binary.BigEndian.PutUint16(message[pos:], uint16(len(frame.ID)))
+	pos += 2 + copy(message[pos+2:], frame.ID)
+	binary.BigEndian.PutUint16(message[pos:], uint16(len(frame.Topic)))
+	pos += 2 + copy(message[pos+2:], frame.Topic)
+	binary.BigEndian.PutUint32(message[pos:], uint32(len(frame.Payload)))
+	copy(message[pos+4:], frame.Payload)
+	return message
+}
+
+// EncodeText converts a message of the text form, as queued on hub.Client.Send,
+// to the framing of the client.
+func EncodeText(framing int, message []byte) []byte {
+	if framing == FramingText || framing == FramingTextID {
+		return message
+	}
+	frame := &Frame{Payload: message}
+	if len(message) >= VerbSize && validVerb(string(message[:VerbSize])) {
+		switch string(message[:VerbSize]) {
+		case VerbAck, VerbNack:
+			frame = decodeText(message, true)
+		default:
+			frame.Verb = string(message[:VerbSize])
+			frame.Payload = message[VerbSize:]
+		}
+	}
+	return Encode(framing, frame)
+}
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/Djoulzy/Polycom/hub"
+)
+
+// VerbSize is the length of a command group : "[" + 4 letters + "]".
+const VerbSize = 6
+
+var (
+	ErrBadVerb          = errors.New("protocol: verb should look like [XXXX]")
+	ErrAlreadyDefined   = errors.New("protocol: verb already registered")
+	ErrTooShort         = errors.New("protocol: message shorter than a verb")
+	ErrUnknownVerb      = errors.New("protocol: unknown verb")
+	ErrHandshakeMissing = errors.New("protocol: handshake required")
+	ErrForbidden        = errors.New("protocol: verb not allowed for this client")
+	ErrBadPayload       = errors.New("protocol: bad payload")
+	ErrNotFound         = errors.New("protocol: target not found")
+	// Returned by handlers closing the connection, no reply can be sent.
+	ErrClosed = errors.New("protocol: connection closed")
+)
+
+// Handler runs a command. payload is the message without its verb and id.
+// The response, if any, is sent back to the client (in the [ACK_] when the
+// command has an id).
+type Handler func(c *hub.Client, payload []byte) ([]byte, error)
+
+// Command describes a verb of the protocol.
+type Command struct {
+	Verb    string
+	Handler Handler
+
+	// Types of client allowed to send the verb, any identified client if empty.
+	ClientTypes []int
+	// Shorter payloads are refused with ErrBadPayload.
+	MinPayload int
+	// When false the verb can be sent before [HELO], by ClientUndefined.
+	NoHandshake bool
+}
+
+// Allows tells if the command metadata accepts a client of type ctype.
+func (cmd *Command) Allows(ctype int) bool {
+	if ctype == hub.ClientUndefined {
+		return cmd.NoHandshake
+	}
+	if len(cmd.ClientTypes) == 0 {
+		return true
+	}
+	for _, allowed := range cmd.ClientTypes {
+		if allowed == ctype {
+			return true
+		}
+	}
+	return false
+}
+
+// Router dispatches the messages of the clients to the registered commands.
+type Router struct {
+	// Authorize replaces the ClientTypes check of identified clients when set.
+	Authorize func(c *hub.Client, cmd *Command) bool
+
+	commands map[string]*Command
+	mutex    sync.RWMutex
+}
+
+func NewRouter() *Router {
+	return &Router{
+		commands: make(map[string]*Command),
+	}
+}
+
+func validVerb(verb string) bool {
+	return len(verb) == VerbSize && verb[0] == '[' && verb[VerbSize-1] == ']'
+}
+
+// Handle registers a command. Verbs can only be registered once.
+func (r *Router) Handle(cmd *Command) error {
+	if !validVerb(cmd.Verb) || cmd.Handler == nil {
+		return ErrBadVerb
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.commands[cmd.Verb] != nil {
+		return ErrAlreadyDefined
+	}
+	r.commands[cmd.Verb] = cmd
+	return nil
+}
+
+// HandleFunc registers a handler usable by any identified client.
+func (r *Router) HandleFunc(verb string, handler Handler) error {
+	return r.Handle(&Command{Verb: verb, Handler: handler})
+}
+
+func (r *Router) Lookup(verb string) *Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.commands[verb]
+}
+
+// Commands returns every registered command.
+func (r *Router) Commands() []*Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	list := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		list = append(list, cmd)
+	}
+	return list
+}
+
+// Dispatch decodes a message, in any framing, and runs its command.
+func (r *Router) Dispatch(c *hub.Client, message []byte) ([]byte, error) {
+	frame, err := Decode(message, AcceptsIDs(c.Framing))
+	if err != nil {
+		return nil, err
+	}
+	return r.DispatchFrame(c, frame)
+}
+
+// DispatchFrame checks the frame against the metadata of its verb and runs the
+// handler. Errors of the handler are returned as is.
+func (r *Router) DispatchFrame(c *hub.Client, frame *Frame) ([]byte, error) {
+	cmd := r.Lookup(frame.Verb)
+	if cmd == nil {
+		return nil, ErrUnknownVerb
+	}
+	if c.CType == hub.ClientUndefined && !cmd.NoHandshake {
+		return nil, ErrHandshakeMissing
+	}
+
+	allowed := cmd.Allows(c.CType)
+	if r.Authorize != nil && c.CType != hub.ClientUndefined {
+		allowed = r.Authorize(c, cmd)
+	}
+	if !allowed {
+		return nil, ErrForbidden
+	}
+
+	payload := frame.Body()
+	if len(payload) < cmd.MinPayload {
+		return nil, ErrBadPayload
+	}
+	return cmd.Handler(c, payload)
+}
@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Djoulzy/Polycom/hub"
+	"github.com/Djoulzy/Tools/clog"
+	"github.com/stretchr/testify/assert"
+)
+
+func newClient(userType int) *hub.Client {
+	return &hub.Client{Name: "ProtocolClient", CType: userType, Send: make(chan []byte, 8), Quit: make(chan bool, 8)}
+}
+
+func dispatchErr(r *Router, c *hub.Client, message []byte) error {
+	_, err := r.Dispatch(c, message)
+	return err
+}
+
+func TestHandle(t *testing.T) {
+	r := NewRouter()
+	handler := func(c *hub.Client, payload []byte) ([]byte, error) { return nil, nil }
+
+	assert.Nil(t, r.HandleFunc("[TEST]", handler))
+	assert.Equal(t, ErrAlreadyDefined, r.HandleFunc("[TEST]", handler))
+	assert.Equal(t, ErrBadVerb, r.HandleFunc("[TOOLONG]", handler))
+	assert.Equal(t, ErrBadVerb, r.HandleFunc("TEST", handler))
+	assert.Equal(t, ErrBadVerb, r.Handle(&Command{Verb: "[NOHD]"}))
+	assert.Equal(t, 1, len(r.Commands()))
+}
+
+func TestDispatch(t *testing.T) {
+	r := NewRouter()
+	var received []byte
+	failure := errors.New("handler failure")
+
+	r.Handle(&Command{
+		Verb:        "[ECHO]",
+		ClientTypes: []int{hub.ClientUser},
+		MinPayload:  2,
+		Handler: func(c *hub.Client, payload []byte) ([]byte, error) {
+			received = payload
+			return []byte("[ECHO]" + string(payload)), nil
+		},
+	})
+	r.Handle(&Command{
+		Verb:        "[HELO]",
+		ClientTypes: []int{hub.ClientUndefined},
+		NoHandshake: true,
+		Handler:     func(c *hub.Client, payload []byte) ([]byte, error) { return nil, nil },
+	})
+	r.HandleFunc("[FAIL]", func(c *hub.Client, payload []byte) ([]byte, error) { return nil, failure })
+
+	user := newClient(hub.ClientUser)
+	response, err := r.Dispatch(user, []byte("[ECHO]hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(received), "Handler should receive the payload")
+	assert.Equal(t, "[ECHO]hello", string(response), "Handler response should be returned")
+
+	assert.Nil(t, dispatchErr(r, user, []byte("[ECHO]#12|hi")))
+	assert.Equal(t, "#12|hi", string(received), "Legacy clients should not send message ids")
+
+	framed := newClient(hub.ClientUser)
+	framed.Framing = FramingTextID
+	assert.Nil(t, dispatchErr(r, framed, []byte("[ECHO]#12|hi")))
+	assert.Equal(t, "hi", string(received), "Message id should not be part of the payload")
+
+	assert.Equal(t, ErrTooShort, dispatchErr(r, user, []byte("[ECH")))
+	assert.Equal(t, ErrUnknownVerb, dispatchErr(r, user, []byte("[NONE]")))
+	assert.Equal(t, ErrBadPayload, dispatchErr(r, user, []byte("[ECHO]h")))
+	assert.Equal(t, ErrForbidden, dispatchErr(r, user, []byte("[HELO]token")))
+	assert.Equal(t, failure, dispatchErr(r, user, []byte("[FAIL]")), "Handler errors should be returned")
+
+	monitor := newClient(hub.ClientMonitor)
+	assert.Equal(t, ErrForbidden, dispatchErr(r, monitor, []byte("[ECHO]hello")))
+	assert.Equal(t, failure, dispatchErr(r, monitor, []byte("[FAIL]")), "Commands without types accept any identified client")
+
+	incomming := newClient(hub.ClientUndefined)
+	assert.Nil(t, dispatchErr(r, incomming, []byte("[HELO]token")))
+	assert.Equal(t, ErrHandshakeMissing, dispatchErr(r, incomming, []byte("[ECHO]hello")))
+
+	r.Authorize = func(c *hub.Client, cmd *Command) bool { return c.CType == hub.ClientMonitor }
+	assert.Nil(t, dispatchErr(r, monitor, []byte("[ECHO]hello")), "Authorize should replace the client types check")
+	assert.Equal(t, ErrForbidden, dispatchErr(r, user, []byte("[ECHO]hello")))
+	assert.Nil(t, dispatchErr(r, incomming, []byte("[HELO]token")), "Authorize is not used before handshake")
+}
+
+func TestFraming(t *testing.T) {
+	frame := &Frame{Verb: "[PUBL]", ID: "42", Topic: "room1", Payload: []byte("a|b\x00\n")}
+
+	for _, framing := range []int{FramingJSON, FramingBinary} {
+		decoded, err := Decode(Encode(framing, frame), true)
+		assert.Nil(t, err)
+		assert.Equal(t, frame, decoded, "Frame should survive an encoding round trip")
+		assert.Equal(t, "room1|a|b\x00\n", string(decoded.Body()), "Bad command body")
+	}
+
+	decoded, err := Decode([]byte("[PUBL]room1|a|b"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, "[PUBL]", decoded.Verb, "Text form should still be accepted")
+	assert.Equal(t, "room1|a|b", string(decoded.Body()))
+
+	metrics := EncodeText(FramingJSON, []byte(`{"SID":"srv1"}`))
+	decoded, err = Decode(metrics, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "", decoded.Verb, "Messages without verb should be kept as payload")
+	assert.Equal(t, `{"SID":"srv1"}`, string(decoded.Payload))
+
+	binary := Encode(FramingBinary, frame)
+	_, err = Decode(binary[:len(binary)-1], true)
+	assert.Equal(t, ErrBadFrame, err, "Truncated frame should be refused")
+	_, err = Decode(append(binary, 0), true)
+	assert.Equal(t, ErrBadFrame, err, "Trailing bytes should be refused")
+	_, err = Decode([]byte(`{"v":2,"verb":"BCST"}`), true)
+	assert.Equal(t, ErrBadVersion, err)
+	_, err = Decode([]byte(`{"v":1,"verb":"BCST","topic":"a|b"}`), true)
+	assert.Equal(t, ErrBadFrame, err, "Topic cannot contain the text separator")
+
+	framing, err := ParseFraming("JSON")
+	assert.Nil(t, err)
+	assert.Equal(t, FramingJSON, framing)
+	_, err = ParseFraming("xml")
+	assert.Equal(t, ErrBadFraming, err)
+}
+
+func TestAck(t *testing.T) {
+	assert.Equal(t, "[ACK_]#12", string(Ack("12", nil)))
+	assert.Equal(t, "[ACK_]#12|v1/key", string(Ack("12", []byte("v1/key"))))
+	assert.Equal(t, "[NACK]#12|NOTFOUND", string(Nack("12", ErrNotFound)))
+	assert.Equal(t, "[NACK]#12|FAILED", string(Nack("12", errors.New("other"))))
+
+	frame, err := Decode([]byte("[UCST]#a1|bob|hello"), true)
+	assert.Nil(t, err)
+	assert.Equal(t, &Frame{Verb: "[UCST]", ID: "a1", Payload: []byte("bob|hello")}, frame, "Bad text frame with id")
+	frame, _ = Decode([]byte("[QUIT]#a2"), true)
+	assert.Equal(t, "a2", frame.ID, "Id without payload")
+	assert.Equal(t, "[QUIT]#a2", string(Encode(FramingText, frame)), "Text form should keep the id")
+
+	decoded, err := Decode(EncodeText(FramingJSON, Nack("a3", ErrForbidden)), true)
+	assert.Nil(t, err)
+	assert.Equal(t, &Frame{Verb: VerbNack, ID: "a3", Payload: []byte(CodeForbidden)}, decoded, "Framed replies should carry the id")
+}
+
+func TestLegacyHash(t *testing.T) {
+	r := NewRouter()
+	var received []byte
+	r.HandleFunc("[BCST]", func(c *hub.Client, payload []byte) ([]byte, error) {
+		received = payload
+		return nil, nil
+	})
+
+	frame, err := Decode([]byte("[BCST]#news"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, "", frame.ID, "Legacy text should not carry ids")
+
+	assert.Nil(t, dispatchErr(r, newClient(hub.ClientUser), []byte("[BCST]#x")))
+	assert.Equal(t, "#x", string(received), "Legacy broadcast should reach the handler unchanged")
+}
+
+func TestMain(m *testing.M) {
+	clog.LogLevel = 5
+	clog.StartLogging = false
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type fileRecord struct {
+	AppID string          `json:"app_id"`
+	Time  string          `json:"time"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// FileDriver appends records to a local JSONL file, one record per line.
+type FileDriver struct {
+	Path  string
+	file  *os.File
+	stats Stats
+	mu    sync.Mutex
+}
+
+func NewFileDriver(path string) (*FileDriver, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDriver{Path: path, file: f}, nil
+}
+
+func (d *FileDriver) NewRecord(app_id string, data string) error {
+	rec := fileRecord{
+		AppID: app_id,
+		Time:  time.Now().Format(time.RFC3339),
+		Data:  json.RawMessage(data),
+	}
+	if !json.Valid(rec.Data) {
+		rec.Data, _ = json.Marshal(data)
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err = d.file.Write(append(line, '\n'))
+	if err != nil {
+		d.stats.Failed++
+	} else {
+		d.stats.Produced++
+	}
+	return err
+}
+
+func (d *FileDriver) Flush(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Sync()
+}
+
+func (d *FileDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
+
+func (d *FileDriver) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
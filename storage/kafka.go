@@ -1,50 +1,178 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Djoulzy/Tools/clog"
 	"github.com/Shopify/sarama"
 )
 
-const (
-	_KAFKA_COMMON_HOST_          = "kafka.vme-tech.com"
-	_KAFKA_COMMON_CONSUMER_PORT_ = 2181
-	_KAFKA_COMMON_PRODUCER_PORT_ = 9092
-	_KAFKA_TOPIC_                = "test_go"
-)
+const flushCheckPeriod = 10 * time.Millisecond
+
+// KafkaDriver keeps a single async producer for the life of the server.
+// Delivery reports are drained in background and counted.
+type KafkaDriver struct {
+	ConnString  []string
+	Topic       string
+	TopicPerApp bool
+	KeyStrategy string
+
+	producer sarama.AsyncProducer
+	inflight int64
+	drained  sync.WaitGroup
+	closed   bool
+	mu       sync.RWMutex
 
-type Driver struct {
-	ConnString []string
-	Store      interface{}
+	produced int64
+	failed   int64
 }
 
-func Init() *Driver {
-	var err error
+func kafkaConfig(p *Params) *sarama.Config {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	switch strings.ToLower(p.KafkaAcks) {
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	}
 
-	d := &Driver{
-		ConnString: []string{fmt.Sprintf("%s:%d", _KAFKA_COMMON_HOST_, _KAFKA_COMMON_PRODUCER_PORT_)},
+	switch strings.ToLower(p.KafkaCompression) {
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+	default:
+		config.Producer.Compression = sarama.CompressionNone
 	}
 
-	d.Store, err = sarama.NewAsyncProducer(d.ConnString, nil)
+	if strings.ToLower(p.KafkaKeyStrategy) == "app_id" {
+		config.Producer.Partitioner = sarama.NewHashPartitioner
+	} else {
+		config.Producer.Partitioner = sarama.NewRandomPartitioner
+	}
+
+	config.Producer.Flush.Messages = p.KafkaFlushMessages
+	config.Producer.Flush.Frequency = time.Duration(p.KafkaFlushFrequency) * time.Millisecond
+
+	return config
+}
+
+func NewKafkaDriver(p *Params) (*KafkaDriver, error) {
+	brokers := strings.Split(p.KafkaBrokers, ",")
+	producer, err := sarama.NewAsyncProducer(brokers, kafkaConfig(p))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	d := newKafkaDriver(producer, p)
+	d.ConnString = brokers
+	return d, nil
+}
+
+func newKafkaDriver(producer sarama.AsyncProducer, p *Params) *KafkaDriver {
+	d := &KafkaDriver{
+		Topic:       p.KafkaTopic,
+		TopicPerApp: p.KafkaTopicPerApp,
+		KeyStrategy: strings.ToLower(p.KafkaKeyStrategy),
+		producer:    producer,
 	}
 
+	d.drained.Add(2)
+	go d.drainSuccesses()
+	go d.drainErrors()
 	return d
 }
 
-// ./kafka-console-consumer.sh --zookeeper localhost:2181 --topic test_go
-func (d *Driver) NewRecord(json string) {
-	defer func() {
-		if err := d.Store.(sarama.AsyncProducer).Close(); err != nil {
-			log.Fatalln(err)
+func (d *KafkaDriver) drainSuccesses() {
+	defer d.drained.Done()
+	for range d.producer.Successes() {
+		atomic.AddInt64(&d.produced, 1)
+		atomic.AddInt64(&d.inflight, -1)
+	}
+}
+
+func (d *KafkaDriver) drainErrors() {
+	defer d.drained.Done()
+	for err := range d.producer.Errors() {
+		atomic.AddInt64(&d.failed, 1)
+		atomic.AddInt64(&d.inflight, -1)
+		clog.Error("Storage", "Kafka", "Failed to produce message to %s: %s", err.Msg.Topic, err.Err)
+	}
+}
+
+// topicFor returns the destination topic of a record.
+func (d *KafkaDriver) topicFor(app_id string) string {
+	if d.TopicPerApp && app_id != "" {
+		return d.Topic + "." + app_id
+	}
+	return d.Topic
+}
+
+// ./kafka-console-consumer.sh --zookeeper localhost:2181 --topic polycom
+func (d *KafkaDriver) NewRecord(app_id string, json string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return errors.New("Kafka producer is closed")
+	}
+
+	msg := &sarama.ProducerMessage{Topic: d.topicFor(app_id), Value: sarama.StringEncoder(json)}
+	if d.KeyStrategy == "app_id" {
+		msg.Key = sarama.StringEncoder(app_id)
+	}
+
+	atomic.AddInt64(&d.inflight, 1)
+	d.producer.Input() <- msg
+	return nil
+}
+
+// Flush waits until every record sent so far has been acknowledged or has
+// failed, or until ctx is done.
+func (d *KafkaDriver) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushCheckPeriod)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&d.inflight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d records not acknowledged: %s", atomic.LoadInt64(&d.inflight), ctx.Err())
 		}
-	}()
+	}
+	return nil
+}
+
+func (d *KafkaDriver) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	d.producer.AsyncClose()
+	d.drained.Wait()
+	return nil
+}
 
-	select {
-	case d.Store.(sarama.AsyncProducer).Input() <- &sarama.ProducerMessage{Topic: _KAFKA_TOPIC_, Key: nil, Value: sarama.StringEncoder(json)}:
-	case err := <-d.Store.(sarama.AsyncProducer).Errors():
-		log.Println("Failed to produce message", err)
+func (d *KafkaDriver) Stats() Stats {
+	return Stats{
+		Produced: atomic.LoadInt64(&d.produced),
+		Failed:   atomic.LoadInt64(&d.failed),
 	}
 }
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKafkaDriver(t *testing.T) {
+	params := &Params{KafkaTopic: "polycom", KafkaKeyStrategy: "app_id"}
+	producer := mocks.NewAsyncProducer(t, kafkaConfig(params))
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+
+	d := newKafkaDriver(producer, params)
+	assert.Nil(t, d.NewRecord("app1", "{\"a\":1}"))
+	assert.Nil(t, d.NewRecord("app1", "{\"a\":2}"))
+	assert.Nil(t, d.NewRecord("app2", "{\"a\":3}"))
+	assert.Nil(t, d.Flush(context.Background()))
+
+	assert.Equal(t, Stats{Produced: 2, Failed: 1}, d.Stats(), "Bad delivery reports")
+
+	atomic.AddInt64(&d.inflight, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, d.Flush(ctx), "Flush should give up at the deadline")
+	atomic.AddInt64(&d.inflight, -1)
+
+	assert.Nil(t, d.Close())
+	assert.NotNil(t, d.NewRecord("app1", "{}"), "Closed driver should refuse records")
+}
+
+func TestKafkaTopicPerApp(t *testing.T) {
+	d := &KafkaDriver{Topic: "polycom", TopicPerApp: true}
+	assert.Equal(t, "polycom.app1", d.topicFor("app1"), "Bad app topic")
+	assert.Equal(t, "polycom", d.topicFor(""), "Records without app_id should use the main topic")
+
+	d.TopicPerApp = false
+	assert.Equal(t, "polycom", d.topicFor("app1"), "Bad topic")
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryDriver keeps records in memory. Nothing survives a restart.
+type MemoryDriver struct {
+	records  []Record
+	produced int64
+	mu       sync.Mutex
+}
+
+func NewMemoryDriver() *MemoryDriver {
+	return &MemoryDriver{}
+}
+
+func (d *MemoryDriver) NewRecord(app_id string, json string) error {
+	d.mu.Lock()
+	d.records = append(d.records, Record{AppID: app_id, Time: time.Now(), Data: json})
+	d.produced++
+	d.mu.Unlock()
+	return nil
+}
+
+// Records returns a copy of the stored records.
+func (d *MemoryDriver) Records() []Record {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Record(nil), d.records...)
+}
+
+func (d *MemoryDriver) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (d *MemoryDriver) Close() error {
+	return nil
+}
+
+func (d *MemoryDriver) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Stats{Produced: d.produced}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Backend is implemented by every [STOR] records store.
+type Backend interface {
+	NewRecord(app_id string, json string) error
+	Flush(ctx context.Context) error // Gives up when ctx is done
+	Close() error
+	Stats() Stats
+}
+
+// Stats counts the records written (or acknowledged) and failed by a backend.
+type Stats struct {
+	Produced int64
+	Failed   int64
+}
+
+type Record struct {
+	AppID string
+	Time  time.Time
+	Data  string
+}
+
+type Params struct {
+	Backend  string
+	FilePath string
+
+	KafkaBrokers        string
+	KafkaTopic          string
+	KafkaTopicPerApp    bool
+	KafkaKeyStrategy    string // none or app_id
+	KafkaAcks           string // none, local or all
+	KafkaCompression    string // none, gzip, snappy, lz4 or zstd
+	KafkaFlushMessages  int
+	KafkaFlushFrequency int // in ms
+}
+
+// Init returns the backend selected by p.Backend : kafka, file or memory.
+func Init(p *Params) (Backend, error) {
+	switch strings.ToLower(p.Backend) {
+	case "kafka":
+		return NewKafkaDriver(p)
+	case "file":
+		return NewFileDriver(p.FilePath)
+	case "memory", "":
+		return NewMemoryDriver(), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %s", p.Backend)
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInit(t *testing.T) {
+	backend, err := Init(&Params{Backend: "memory"})
+	assert.Nil(t, err)
+	assert.IsType(t, &MemoryDriver{}, backend, "Bad backend")
+
+	_, err = Init(&Params{Backend: "mongo"})
+	assert.NotNil(t, err, "Unknown backend should be refused")
+}
+
+func TestMemoryDriver(t *testing.T) {
+	d := NewMemoryDriver()
+	d.NewRecord("app1", "{\"a\":1}")
+	d.NewRecord("app2", "{\"a\":2}")
+
+	records := d.Records()
+	assert.Equal(t, 2, len(records), "Bad number of records")
+	assert.Equal(t, "app2", records[1].AppID, "Bad record app_id")
+	assert.Equal(t, "{\"a\":2}", records[1].Data, "Bad record data")
+}
+
+func TestFileDriver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+
+	d, err := NewFileDriver(path)
+	assert.Nil(t, err)
+	assert.Nil(t, d.NewRecord("app1", "{\"a\":1}"))
+	assert.Nil(t, d.NewRecord("app1", "not json"))
+	assert.Nil(t, d.Close())
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	var lines []fileRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec fileRecord
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &rec), "Each line should be valid JSON")
+		lines = append(lines, rec)
+	}
+	assert.Equal(t, 2, len(lines), "Bad number of lines")
+	assert.Equal(t, "{\"a\":1}", string(lines[0].Data), "Bad record data")
+	assert.Equal(t, "\"not json\"", string(lines[1].Data), "Non JSON records should be quoted")
+}
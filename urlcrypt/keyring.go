@@ -0,0 +1,91 @@
+package urlcrypt
+
+import (
+	"strings"
+)
+
+// Keyring lists the keys of a Cypher. Tokens are encrypted with the Current
+// key and decrypted with any key which is not Retired.
+type Keyring struct {
+	Keys    map[string]string // key ID -> hex key
+	Current string
+	Retired []string
+}
+
+// SetKeyring checks and installs a new keyring. It can be called while the
+// cypher is in use, to add or retire keys without restarting.
+func (uc *Cypher) SetKeyring(kr *Keyring) error {
+	keys := make(map[string][]byte, len(kr.Keys))
+	for id, hex_key := range kr.Keys {
+		if id == "" || strings.Contains(id, "/") {
+			return ErrBadKey
+		}
+		if _, err := newBlock([]byte(hex_key)); err != nil {
+			return ErrBadKey
+		}
+		keys[id] = []byte(hex_key)
+	}
+
+	retired := make(map[string]bool, len(kr.Retired))
+	for _, id := range kr.Retired {
+		retired[id] = true
+	}
+
+	if keys[kr.Current] == nil {
+		return ErrUnknownKey
+	}
+	if retired[kr.Current] {
+		return ErrRetiredKey
+	}
+
+	uc.mu.Lock()
+	uc.keys = keys
+	uc.current = kr.Current
+	uc.retired = retired
+	uc.mu.Unlock()
+	return nil
+}
+
+// currentKey returns the encryption key and its ID. The ID is empty when no
+// keyring is set and HEX_KEY is used.
+func (uc *Cypher) currentKey() (string, []byte) {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	if uc.keys == nil {
+		return "", uc.HEX_KEY
+	}
+	return uc.current, uc.keys[uc.current]
+}
+
+func (uc *Cypher) lookupKey(id string) ([]byte, error) {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	switch {
+	case uc.retired[id]:
+		return nil, ErrRetiredKey
+	case uc.keys[id] == nil:
+		return nil, ErrUnknownKey
+	}
+	return uc.keys[id], nil
+}
+
+// activeKeys returns the keys accepted for tokens without key ID (v0 and v1),
+// the current one first.
+func (uc *Cypher) activeKeys() [][]byte {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	if uc.keys == nil {
+		return [][]byte{uc.HEX_KEY}
+	}
+
+	list := [][]byte{uc.keys[uc.current]}
+	for id, hex_key := range uc.keys {
+		if id != uc.current && !uc.retired[id] {
+			list = append(list, hex_key)
+		}
+	}
+	return list
+}
@@ -0,0 +1,60 @@
+package urlcrypt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NewHandshake returns the encrypted [HELO] token of a client for the server
+// listening on target (its HTTPaddr, or its TCPaddr for a brother):
+// <name>|<app_id or addr>|<client_type>|<issue_timestamp>|<nonce>|<target>
+func (uc *Cypher) NewHandshake(name string, app_id string, ctype string, target string) ([]byte, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return uc.Encrypt_b64(fmt.Sprintf("%s|%s|%s|%d|%s|%s", name, app_id, ctype, time.Now().Unix(), hex.EncodeToString(nonce), target))
+}
+
+// NonceCache remembers the handshake nonces seen during the last ttl. It is
+// not shared between the servers of a mesh, the tokens being bound to their
+// target server.
+type NonceCache struct {
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastPurge time.Time
+	mu        sync.Mutex
+}
+
+func NewNonceCache(ttl time.Duration) *NonceCache {
+	return &NonceCache{
+		ttl:       ttl,
+		seen:      make(map[string]time.Time),
+		lastPurge: time.Now(),
+	}
+}
+
+// Use records a nonce and returns false if it was already used.
+func (nc *NonceCache) Use(nonce string) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(nc.lastPurge) > nc.ttl {
+		for n, expire := range nc.seen {
+			if now.After(expire) {
+				delete(nc.seen, n)
+			}
+		}
+		nc.lastPurge = now
+	}
+
+	if expire, ok := nc.seen[nonce]; ok && now.Before(expire) {
+		return false
+	}
+	nc.seen[nonce] = now.Add(nc.ttl)
+	return true
+}
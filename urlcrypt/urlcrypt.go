@@ -5,30 +5,48 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
-	"math/rand"
 	"strings"
-	"time"
+	"sync"
+)
+
+// Token versions. v0 is the legacy "<iv>/<text>" AES-CBC scheme, only decoded
+// when AcceptLegacy is set. v1 is "v1/<nonce>/<text>" using AES-GCM.
+// v2 is "v2/<key_id>/<nonce>/<text>" using AES-GCM with a key of the keyring.
+const (
+	TokenV1 = "v1"
+	TokenV2 = "v2"
+)
 
-	"github.com/Djoulzy/Tools/clog"
+var (
+	ErrBadScheme    = errors.New("urlcrypt: bad token scheme")
+	ErrBadBase64    = errors.New("urlcrypt: bad base64 encoding")
+	ErrBadKey       = errors.New("urlcrypt: bad key")
+	ErrBadIV        = errors.New("urlcrypt: bad IV or nonce size")
+	ErrBadBlockSize = errors.New("urlcrypt: ciphertext is not a multiple of the block size")
+	ErrBadPadding   = errors.New("urlcrypt: bad padding")
+	ErrBadSignature = errors.New("urlcrypt: bad signature")
+	ErrUnknownKey   = errors.New("urlcrypt: unknown key ID")
+	ErrRetiredKey   = errors.New("urlcrypt: retired key ID")
 )
 
 type Cypher struct {
-	HASH_SIZE int // Should be 8
-	HEX_KEY   []byte
-	HEX_IV    []byte
+	HASH_SIZE    int    // Should be 8, v0 signature size
+	HEX_KEY      []byte // Only used while no keyring is set
+	AcceptLegacy bool
+
+	keys    map[string][]byte
+	current string
+	retired map[string]bool
+	mu      sync.RWMutex
 }
 
 func (uc *Cypher) GenIV_bin() []byte {
 	iv_bin := make([]byte, 16)
-
-	newRand := rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
-	for i := 0; i < 16; i++ {
-		iv_bin[i] = byte(newRand.Intn(256))
-	}
-
+	rand.Read(iv_bin)
 	return iv_bin
 }
 
@@ -40,48 +58,41 @@ func (uc *Cypher) GenIV_hex() []byte {
 	return dst
 }
 
-func (*Cypher) pkcs7pad(data []byte, blockSize int) []byte {
-
-	var paddingCount int
-
-	if paddingCount = blockSize - (len(data) % blockSize); paddingCount == 0 {
-		paddingCount = blockSize
-	}
-
-	return append(data, bytes.Repeat([]byte{byte(paddingCount)}, paddingCount)...)
-}
-
-// RemovePkcs7 removes pkcs7 padding from previously padded byte array
-func (uc *Cypher) pkcs7unpad(padded []byte, blockSize int) []byte {
+// pkcs7unpad removes pkcs7 padding from previously padded byte array
+func (uc *Cypher) pkcs7unpad(padded []byte, blockSize int) ([]byte, error) {
 
 	dataLen := len(padded)
+	if dataLen == 0 || dataLen%blockSize != 0 {
+		return nil, ErrBadPadding
+	}
 	paddingCount := int(padded[dataLen-1])
 
 	if paddingCount > blockSize || paddingCount <= 0 {
-		return padded //data is not padded (or not padded correctly), return as is
+		return nil, ErrBadPadding
 	}
 
 	padding := padded[dataLen-paddingCount : dataLen-1]
 
 	for _, b := range padding {
 		if int(b) != paddingCount {
-			return padded //data is not padded (or not padded correcly), return as is
+			return nil, ErrBadPadding
 		}
 	}
 
-	return padded[:len(padded)-paddingCount] //return data - padding
+	return padded[:len(padded)-paddingCount], nil //return data - padding
 }
 
 func (uc *Cypher) encodeBase64(b []byte) []byte {
-	return []byte(base64.StdEncoding.EncodeToString(b))
+	return []byte(base64.RawURLEncoding.EncodeToString(b))
 }
 
-func (uc *Cypher) decodeBase64(s string) []byte {
-	data, err := base64.StdEncoding.DecodeString(s)
+// decodeBase64 reads the url safe, unpadded, base64 used in tokens.
+func (uc *Cypher) decodeBase64(s string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
 	if err != nil {
-		clog.Fatal("Crypt", "decodeBase64", err)
+		return nil, ErrBadBase64
 	}
-	return data
+	return data, nil
 }
 
 func (uc *Cypher) GetMD5Hash(text string) []byte {
@@ -92,79 +103,154 @@ func (uc *Cypher) GetMD5Hash(text string) []byte {
 	return md5
 }
 
-func (uc *Cypher) Encrypt_b64(text string) ([]byte, error) {
-	var iv_bin []byte
-
-	key_bin := make([]byte, hex.DecodedLen(len(uc.HEX_KEY)))
-	hex.Decode(key_bin, uc.HEX_KEY)
-
-	if len(uc.HEX_IV) == 0 {
-		iv_bin = uc.GenIV_bin()
-	} else {
-		iv_bin = make([]byte, hex.DecodedLen(len(uc.HEX_IV)))
-		hex.Decode(iv_bin, uc.HEX_IV)
+func newBlock(hex_key []byte) (cipher.Block, error) {
+	key_bin := make([]byte, hex.DecodedLen(len(hex_key)))
+	if _, err := hex.Decode(key_bin, hex_key); err != nil {
+		return nil, ErrBadKey
 	}
 
 	block, err := aes.NewCipher(key_bin)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	return block, nil
+}
+
+func newGCM(hex_key []byte) (cipher.AEAD, error) {
+	block, err := newBlock(hex_key)
 	if err != nil {
 		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	textHash := (uc.GetMD5Hash(text))[0:8]
+// Encrypt_b64 returns a v2 token using the current key of the keyring,
+// or a v1 token using HEX_KEY when no keyring is set.
+func (uc *Cypher) Encrypt_b64(text string) ([]byte, error) {
+	id, hex_key := uc.currentKey()
 
-	signedText := append(textHash, []byte(text)...)
-	text_padded := uc.pkcs7pad(signedText, aes.BlockSize)
+	aead, err := newGCM(hex_key)
+	if err != nil {
+		return nil, err
+	}
 
-	cbc := cipher.NewCBCEncrypter(block, iv_bin)
-	cbc.CryptBlocks(text_padded, text_padded)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
 
-	iv_b64 := bytes.TrimRight(bytes.Replace(bytes.Replace(uc.encodeBase64(iv_bin), []byte{'/'}, []byte{'_'}, -1), []byte{'+'}, []byte{'-'}, -1), "=")
-	text_b64 := bytes.TrimRight(bytes.Replace(bytes.Replace(uc.encodeBase64(text_padded), []byte{'/'}, []byte{'_'}, -1), []byte{'+'}, []byte{'-'}, -1), "=")
+	header := TokenV1
+	if id != "" {
+		header = TokenV2 + "/" + id
+	}
+	sealed := aead.Seal(nil, nonce, []byte(text), []byte(header))
 
-	return append(append(iv_b64, '/'), text_b64...), nil
+	token := append([]byte(header+"/"), uc.encodeBase64(nonce)...)
+	token = append(token, '/')
+	return append(token, uc.encodeBase64(sealed)...), nil
+}
+
+// IsLegacy tells if a token uses the v0 scheme.
+func IsLegacy(enc_text string) bool {
+	return strings.Count(enc_text, "/") == 1
 }
 
 func (uc *Cypher) Decrypt_b64(enc_text string) ([]byte, error) {
 	encoded_str := strings.Split(enc_text, "/")
-	if len(encoded_str) < 2 {
-		return nil, errors.New("Bad string scheme")
+	switch {
+	case len(encoded_str) == 4 && encoded_str[0] == TokenV2:
+		hex_key, err := uc.lookupKey(encoded_str[1])
+		if err != nil {
+			return nil, err
+		}
+		return uc.decryptGCM(hex_key, TokenV2+"/"+encoded_str[1], encoded_str[2], encoded_str[3])
+	case len(encoded_str) == 3 && encoded_str[0] == TokenV1:
+		return uc.tryActiveKeys(func(hex_key []byte) ([]byte, error) {
+			return uc.decryptGCM(hex_key, TokenV1, encoded_str[1], encoded_str[2])
+		})
+	case len(encoded_str) == 2 && uc.AcceptLegacy:
+		return uc.tryActiveKeys(func(hex_key []byte) ([]byte, error) {
+			return uc.decryptV0(hex_key, encoded_str[0], encoded_str[1])
+		})
+	default:
+		return nil, ErrBadScheme
 	}
+}
 
-	padder := "===="
-	iv_pad := ""
-	if len(encoded_str[0])%4 > 0 {
-		iv_pad = padder[len(encoded_str[0])%4:]
-	}
-	text_pad := ""
-	if len(encoded_str[1])%4 > 0 {
-		text_pad = padder[len(encoded_str[1])%4:]
+// tryActiveKeys decrypts tokens without key ID with every active key, until one matches.
+func (uc *Cypher) tryActiveKeys(decrypt func([]byte) ([]byte, error)) ([]byte, error) {
+	err := ErrUnknownKey
+	for _, hex_key := range uc.activeKeys() {
+		var clear []byte
+		if clear, err = decrypt(hex_key); err == nil {
+			return clear, nil
+		}
 	}
+	return nil, err
+}
 
-	iv_b64 := strings.Replace(strings.Replace(encoded_str[0], "_", "/", -1), "-", "+", -1) + iv_pad
-	text_b64 := strings.Replace(strings.Replace(encoded_str[1], "_", "/", -1), "-", "+", -1) + text_pad
+func (uc *Cypher) decryptGCM(hex_key []byte, header string, nonce_b64 string, text_b64 string) ([]byte, error) {
+	aead, err := newGCM(hex_key)
+	if err != nil {
+		return nil, err
+	}
 
-	// clog.Info("Crypt", "Decrypt_b64", "IV_B64: %s\nTXT_B64: %s", iv_b64, text_b64)
+	nonce, err := uc.decodeBase64(nonce_b64)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrBadIV
+	}
+	text_bin, err := uc.decodeBase64(text_b64)
+	if err != nil {
+		return nil, err
+	}
 
-	key_bin := make([]byte, hex.DecodedLen(len(uc.HEX_KEY)))
-	hex.Decode(key_bin, uc.HEX_KEY)
-	iv_bin := uc.decodeBase64(iv_b64)
-	text_bin := uc.decodeBase64(text_b64)
+	clear, err := aead.Open(nil, nonce, text_bin, []byte(header))
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	return clear, nil
+}
 
-	block, err := aes.NewCipher(key_bin)
+// decryptV0 decodes a legacy AES-CBC token and checks its MD5 signature.
+func (uc *Cypher) decryptV0(hex_key []byte, iv_b64 string, text_b64 string) ([]byte, error) {
+	block, err := newBlock(hex_key)
 	if err != nil {
 		return nil, err
 	}
 
-	// iv_bin = iv_bin[:aes.BlockSize]
-	// text_bin = text_bin[aes.BlockSize:]
-	if len(text_bin)%aes.BlockSize != 0 {
-		panic("ciphertext is not a multiple of the block size")
+	iv_bin, err := uc.decodeBase64(iv_b64)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv_bin) != aes.BlockSize {
+		return nil, ErrBadIV
+	}
+	text_bin, err := uc.decodeBase64(text_b64)
+	if err != nil {
+		return nil, err
+	}
+	if len(text_bin) == 0 || len(text_bin)%aes.BlockSize != 0 {
+		return nil, ErrBadBlockSize
 	}
 
 	cbc := cipher.NewCBCDecrypter(block, iv_bin)
 	cbc.CryptBlocks(text_bin, text_bin)
-	text_unpadded := uc.pkcs7unpad(text_bin, aes.BlockSize)
+	text_unpadded, err := uc.pkcs7unpad(text_bin, aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if uc.HASH_SIZE <= 0 || len(text_unpadded) < uc.HASH_SIZE || uc.HASH_SIZE > md5.Size {
+		return nil, ErrBadSignature
+	}
+	signature := text_unpadded[:uc.HASH_SIZE]
 	text_unpadded = text_unpadded[uc.HASH_SIZE:]
+	if !bytes.Equal(signature, uc.GetMD5Hash(string(text_unpadded))[:uc.HASH_SIZE]) {
+		return nil, ErrBadSignature
+	}
 
 	return text_unpadded, nil
 }
@@ -2,7 +2,9 @@ package urlcrypt
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Djoulzy/Tools/clog"
 	"github.com/stretchr/testify/assert"
@@ -12,11 +14,175 @@ func TestEncrypt(t *testing.T) {
 	var cryptor = &Cypher{
 		HASH_SIZE: 8,
 		HEX_KEY:   []byte("d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473"),
-		HEX_IV:    []byte("046b51957f00c25929e8ccaad3bfe1a7"),
 	}
 
 	crypted, _ := cryptor.Encrypt_b64("iphone1|xcode|USER")
-	assert.Equal(t, "BGtRlX8Awlkp6Myq07_hpw/QvGzLgBaPZiJgeKdpfg7HZzBhEaspxOJaCBv-05d96k", string(crypted), "Bad encryption")
+	assert.Equal(t, true, strings.HasPrefix(string(crypted), "v1/"), "Bad token version")
+
+	crypted2, _ := cryptor.Encrypt_b64("iphone1|xcode|USER")
+	assert.NotEqual(t, crypted, crypted2, "Nonces should never be reused")
+
+	clear, err := cryptor.Decrypt_b64(string(crypted))
+	assert.Nil(t, err)
+	assert.Equal(t, "iphone1|xcode|USER", string(clear), "Bad decryption")
+
+	tampered := []byte(string(crypted))
+	if tampered[len(tampered)-5] == 'A' {
+		tampered[len(tampered)-5] = 'B'
+	} else {
+		tampered[len(tampered)-5] = 'A'
+	}
+	_, err = cryptor.Decrypt_b64(string(tampered))
+	assert.Equal(t, ErrBadSignature, err, "Tampered token should be refused")
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	var cryptor = &Cypher{
+		HASH_SIZE: 8,
+		HEX_KEY:   []byte("d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473"),
+	}
+	legacy := "BGtRlX8Awlkp6Myq07_hpw/QvGzLgBaPZiJgeKdpfg7HZzBhEaspxOJaCBv-05d96k"
+
+	_, err := cryptor.Decrypt_b64(legacy)
+	assert.Equal(t, ErrBadScheme, err, "Legacy tokens should be refused by default")
+
+	cryptor.AcceptLegacy = true
+	clear, err := cryptor.Decrypt_b64(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, "iphone1|xcode|USER", string(clear), "Bad legacy decryption")
+}
+
+func TestDecryptErrors(t *testing.T) {
+	var cryptor = &Cypher{
+		HASH_SIZE:    8,
+		HEX_KEY:      []byte("d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473"),
+		AcceptLegacy: true,
+	}
+
+	_, err := cryptor.Decrypt_b64("garbage")
+	assert.Equal(t, ErrBadScheme, err)
+	_, err = cryptor.Decrypt_b64("v1/!!!/AAAA")
+	assert.Equal(t, ErrBadBase64, err)
+	_, err = cryptor.Decrypt_b64("v1/AAAA/AAAA")
+	assert.Equal(t, ErrBadIV, err)
+	_, err = cryptor.Decrypt_b64("BGtRlX8Awlkp6Myq07_hpw/QvGzLgBa")
+	assert.Equal(t, ErrBadBlockSize, err)
+	_, err = cryptor.Decrypt_b64("BGtRlX8Awlkp6Myq07_hpw/")
+	assert.Equal(t, ErrBadBlockSize, err)
+	_, err = cryptor.Decrypt_b64("AAAAAAAAAAAAAAAAAAAAAA/QvGzLgBaPZiJgeKdpfg7HZzBhEaspxOJaCBv-05d96k")
+	assert.NotNil(t, err, "Wrong IV should be refused")
+
+	cryptor.HEX_KEY = []byte("not hex")
+	_, err = cryptor.Decrypt_b64("v1/AAAA/AAAA")
+	assert.Equal(t, ErrBadKey, err)
+}
+
+func TestKeyring(t *testing.T) {
+	var cryptor = &Cypher{
+		HASH_SIZE:    8,
+		HEX_KEY:      []byte("d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473"),
+		AcceptLegacy: true,
+	}
+	v1, _ := cryptor.Encrypt_b64("iphone1|xcode|USER")
+	legacy := "BGtRlX8Awlkp6Myq07_hpw/QvGzLgBaPZiJgeKdpfg7HZzBhEaspxOJaCBv-05d96k"
+
+	err := cryptor.SetKeyring(&Keyring{
+		Keys: map[string]string{
+			"k1": "d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473",
+			"k2": "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		},
+		Current: "k2",
+	})
+	assert.Nil(t, err)
+
+	v2, _ := cryptor.Encrypt_b64("iphone1|xcode|USER")
+	assert.Equal(t, true, strings.HasPrefix(string(v2), "v2/k2/"), "Token should carry the current key ID")
+
+	for _, token := range []string{string(v1), string(v2), legacy} {
+		clear, err := cryptor.Decrypt_b64(token)
+		assert.Nil(t, err)
+		assert.Equal(t, "iphone1|xcode|USER", string(clear), "Active keys should all be accepted")
+	}
+
+	_, err = cryptor.Decrypt_b64(strings.Replace(string(v2), "v2/k2/", "v2/k3/", 1))
+	assert.Equal(t, ErrUnknownKey, err)
+	_, err = cryptor.Decrypt_b64(strings.Replace(string(v2), "v2/k2/", "v2/k1/", 1))
+	assert.Equal(t, ErrBadSignature, err, "Key ID is authenticated")
+
+	err = cryptor.SetKeyring(&Keyring{
+		Keys: map[string]string{
+			"k1": "d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473",
+			"k2": "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		},
+		Current: "k2",
+		Retired: []string{"k1"},
+	})
+	assert.Nil(t, err)
+	_, err = cryptor.Decrypt_b64(string(v1))
+	assert.Equal(t, ErrBadSignature, err, "Retired key should not be tried")
+	_, err = cryptor.Decrypt_b64(string(v2))
+	assert.Nil(t, err)
+
+	err = cryptor.SetKeyring(&Keyring{Keys: map[string]string{"k1": "not hex"}, Current: "k1"})
+	assert.Equal(t, ErrBadKey, err)
+	err = cryptor.SetKeyring(&Keyring{Keys: map[string]string{"k/1": "0123456789abcdef0123456789abcdef"}, Current: "k/1"})
+	assert.Equal(t, ErrBadKey, err, "Key ID should not contain a slash")
+	err = cryptor.SetKeyring(&Keyring{Keys: map[string]string{"k1": "0123456789abcdef0123456789abcdef"}, Current: "k2"})
+	assert.Equal(t, ErrUnknownKey, err)
+	err = cryptor.SetKeyring(&Keyring{Keys: map[string]string{"k1": "0123456789abcdef0123456789abcdef"}, Current: "k1", Retired: []string{"k1"}})
+	assert.Equal(t, ErrRetiredKey, err)
+
+	_, err = cryptor.Decrypt_b64(string(v2))
+	assert.Nil(t, err, "A refused keyring should not replace the current one")
+}
+
+func FuzzDecrypt_b64(f *testing.F) {
+	var cryptor = &Cypher{
+		HASH_SIZE:    8,
+		HEX_KEY:      []byte("d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473"),
+		AcceptLegacy: true,
+	}
+	valid, _ := cryptor.Encrypt_b64("iphone1|xcode|USER")
+
+	f.Add(string(valid))
+	f.Add("BGtRlX8Awlkp6Myq07_hpw/QvGzLgBaPZiJgeKdpfg7HZzBhEaspxOJaCBv-05d96k")
+	f.Add("v1//")
+	f.Add("/")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, token string) {
+		clear, err := cryptor.Decrypt_b64(token)
+		if err == nil && clear == nil {
+			t.Errorf("No error and no data for %q", token)
+		}
+	})
+}
+
+func TestNewHandshake(t *testing.T) {
+	var cryptor = &Cypher{
+		HASH_SIZE: 8,
+		HEX_KEY:   []byte("d87fbb277eefe245ee384b6098637513462f5151336f345778706b462f724473"),
+	}
+
+	token1, _ := cryptor.NewHandshake("iphone1", "xcode", "USER", "localhost:8080")
+	token2, _ := cryptor.NewHandshake("iphone1", "xcode", "USER", "localhost:8080")
+	assert.NotEqual(t, token1, token2, "Two handshakes should never be equal")
+
+	clear, _ := cryptor.Decrypt_b64(string(token1))
+	infos := strings.Split(string(clear), "|")
+	assert.Equal(t, 6, len(infos), "Bad handshake format")
+	assert.Equal(t, "iphone1|xcode|USER", strings.Join(infos[0:3], "|"), "Bad handshake content")
+	assert.Equal(t, "localhost:8080", infos[5], "Token should be bound to its target server")
+}
+
+func TestNonceCache(t *testing.T) {
+	nc := NewNonceCache(50 * time.Millisecond)
+
+	assert.Equal(t, true, nc.Use("nonce1"), "New nonce should be accepted")
+	assert.Equal(t, false, nc.Use("nonce1"), "Reused nonce should be refused")
+	assert.Equal(t, true, nc.Use("nonce2"), "New nonce should be accepted")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, true, nc.Use("nonce1"), "Expired nonce should be forgotten")
 }
 
 func TestMain(m *testing.M) {